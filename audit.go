@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Audit log defaults
+const (
+	DefaultAuditMaxSize    = 100 << 20
+	DefaultAuditMaxBackups = 5
+)
+
+// QueryStats records how one query of a request went
+type QueryStats struct {
+	Query     string
+	Start     time.Time
+	Duration  time.Duration
+	Rows      uint64 // rows sent to the client, over all result sets
+	Affected  uint64
+	ErrorCode uint32 // MySQL error number, or the tunnel's error code
+	Error     string
+	Truncated bool // a result set hit the result limit
+	aborted   bool // the statement was stopped by closing its connection
+}
+
+// fail records a query error
+func (st *QueryStats) fail(errno uint32, err error, message string) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		errno = uint32(mysqlErr.Number)
+	}
+	st.ErrorCode = errno
+	st.Error = message
+}
+
+// AuditLog writes one JSON line per tunnel request, or per query for query
+// requests, answering who ran what against which server
+type AuditLog struct {
+	handler slog.Handler
+	redact  bool
+}
+
+// NewAuditLog creates an audit log writing to w. With redact set, string
+// and numeric literals are left out of the logged queries.
+func NewAuditLog(w io.Writer, redact bool) *AuditLog {
+	return &AuditLog{handler: slog.NewJSONHandler(w, nil), redact: redact}
+}
+
+// requestAttrs describes who sent a request and where it was going
+func requestAttrs(r *http.Request, p ConnParams, action string) []slog.Attr {
+	return []slog.Attr{
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.String("tunnel_user", TunnelUser(r.Context())),
+		slog.String("host", p.Host),
+		slog.String("port", p.Port),
+		slog.String("db", p.Database),
+		slog.String("login", p.User),
+		slog.String("action", action),
+	}
+}
+
+// Request records a request which ran no queries, such as a connection test
+// or one rejected before reaching the server
+func (a *AuditLog) Request(r *http.Request, p ConnParams, action string, start time.Time, errorCode uint32, message string) {
+	if a == nil {
+		return
+	}
+	attrs := append(requestAttrs(r, p, action),
+		slog.Float64("duration_ms", durationMS(time.Since(start))),
+		slog.Int("error_code", int(errorCode)),
+	)
+	if message != "" {
+		attrs = append(attrs, slog.String("error", message))
+	}
+	a.write(start, "request", attrs)
+}
+
+// Queries records each query of a query request
+func (a *AuditLog) Queries(r *http.Request, p ConnParams, stats []QueryStats) {
+	if a == nil {
+		return
+	}
+	base := requestAttrs(r, p, "Q")
+	for _, st := range stats {
+		query := st.Query
+		if a.redact {
+			query = RedactLiterals(query)
+		}
+		attrs := append(base[:len(base):len(base)],
+			slog.String("query", query),
+			slog.Float64("duration_ms", durationMS(st.Duration)),
+			slog.Uint64("rows", st.Rows),
+			slog.Uint64("affected", st.Affected),
+			slog.Int("error_code", int(st.ErrorCode)),
+		)
+		if st.Error != "" {
+			attrs = append(attrs, slog.String("error", st.Error))
+		}
+		if st.Truncated {
+			attrs = append(attrs, slog.Bool("truncated", true))
+		}
+		a.write(st.Start, "query", attrs)
+	}
+}
+
+// write logs an entry stamped with the time the request or query started
+func (a *AuditLog) write(t time.Time, msg string, attrs []slog.Attr) {
+	record := slog.NewRecord(t, slog.LevelInfo, msg, 0)
+	record.AddAttrs(attrs...)
+	if err := a.handler.Handle(context.Background(), record); err != nil {
+		log.Printf("writing audit log: %v", err)
+	}
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Tunnel authentication
+const (
+	TokenHeader      = "X-Tunnel-Token"
+	TokenFormField   = "tunnel_token"
+	DefaultTokenUser = "default"
+)
+
+// Authenticator checks the tunnel credentials of a request before any action
+// is dispatched. Credentials are a tunnel user and its shared secret, sent
+// as HTTP basic auth, in the X-Tunnel-Token header or in the tunnel_token
+// form field. The header and form field take either "user:secret" or the
+// bare secret.
+type Authenticator struct {
+	secrets map[string][32]byte // tunnel user -> hash of its secret
+}
+
+// NewAuthenticator creates an authenticator for the given user secrets
+func NewAuthenticator(users map[string]string) *Authenticator {
+	a := &Authenticator{secrets: make(map[string][32]byte, len(users))}
+	for user, secret := range users {
+		a.secrets[user] = sha256.Sum256([]byte(secret))
+	}
+	return a
+}
+
+// LoadAuthFile reads "user:secret" lines from a file. Empty lines and lines
+// starting with # are skipped.
+func LoadAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, secret, ok := strings.Cut(text, ":")
+		if !ok || user == "" || secret == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:secret", path, line)
+		}
+		users[user] = secret
+	}
+	return users, scanner.Err()
+}
+
+// check compares a secret against a user's in constant time
+func (a *Authenticator) check(user, secret string) bool {
+	want, ok := a.secrets[user]
+	got := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1 && ok
+}
+
+// match finds the user a bare secret belongs to
+func (a *Authenticator) match(secret string) (string, bool) {
+	got := sha256.Sum256([]byte(secret))
+	found := ""
+	for user, want := range a.secrets {
+		if subtle.ConstantTimeCompare(want[:], got[:]) == 1 {
+			found = user
+		}
+	}
+	return found, found != ""
+}
+
+// Authenticate returns the tunnel user of a request. The request form must
+// already be parsed.
+func (a *Authenticator) Authenticate(r *http.Request) (string, bool) {
+	if user, secret, ok := r.BasicAuth(); ok {
+		return user, a.check(user, secret)
+	}
+
+	token := r.Header.Get(TokenHeader)
+	if token == "" {
+		token = r.Form.Get(TokenFormField)
+	}
+	if token == "" {
+		return "", false
+	}
+	if user, secret, ok := strings.Cut(token, ":"); ok && a.check(user, secret) {
+		return user, true
+	}
+	return a.match(token)
+}
+
+// RequireAuth serves h only to requests with valid tunnel credentials. It
+// guards the endpoints served next to the tunnel, such as the metrics.
+func (a *Authenticator) RequireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := a.Authenticate(r); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ntunnel"`)
+			http.Error(w, "tunnel authentication failed", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type tunnelUserKey struct{}
+
+// WithTunnelUser returns a context carrying the authenticated tunnel user
+func WithTunnelUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, tunnelUserKey{}, user)
+}
+
+// TunnelUser returns the authenticated tunnel user of a request context
+func TunnelUser(ctx context.Context) string {
+	user, _ := ctx.Value(tunnelUserKey{}).(string)
+	return user
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	a := NewAuthenticator(map[string]string{"alice": "s3cret", "bob": "hunter2"})
+	tests := []struct {
+		name     string
+		basic    []string // user and password, if set
+		header   string
+		form     string
+		wantUser string
+		wantOK   bool
+	}{
+		{"basic auth", []string{"alice", "s3cret"}, "", "", "alice", true},
+		{"basic auth wrong secret", []string{"alice", "hunter2"}, "", "", "alice", false},
+		{"basic auth unknown user", []string{"carol", "s3cret"}, "", "", "carol", false},
+		{"basic auth empty secret", []string{"alice", ""}, "", "", "alice", false},
+		{"header user and secret", nil, "bob:hunter2", "", "bob", true},
+		{"header bare secret", nil, "hunter2", "", "bob", true},
+		{"header wrong secret", nil, "bob:s3cret", "", "", false},
+		{"header unknown secret", nil, "letmein", "", "", false},
+		{"form field", nil, "", "tunnel_token=alice%3As3cret", "alice", true},
+		{"form field bare secret", nil, "", "tunnel_token=s3cret", "alice", true},
+		{"header before form field", nil, "letmein", "tunnel_token=s3cret", "", false},
+		{"no credentials", nil, "", "", "", false},
+		{"empty form field", nil, "", "tunnel_token=", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.basic != nil {
+			r.SetBasicAuth(tt.basic[0], tt.basic[1])
+		}
+		if tt.header != "" {
+			r.Header.Set(TokenHeader, tt.header)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		user, ok := a.Authenticate(r)
+		if ok != tt.wantOK || (ok && user != tt.wantUser) {
+			t.Errorf("%s: Authenticate = %q, %v, want %q, %v", tt.name, user, ok, tt.wantUser, tt.wantOK)
+		}
+	}
+}
+
+func TestLoadAuthFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{"users", "# tunnel users\nalice:s3cret\n\n  bob:a:b  \n", map[string]string{"alice": "s3cret", "bob": "a:b"}, ""},
+		{"empty", "", map[string]string{}, ""},
+		{"missing secret", "alice:s3cret\nbob:\n", nil, ":2: expected user:secret"},
+		{"missing user", ":s3cret\n", nil, ":1: expected user:secret"},
+		{"no separator", "alice\n", nil, ":1: expected user:secret"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		users, err := LoadAuthFile(path)
+		if tt.wantErr != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want one ending in %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(users) != len(tt.want) {
+			t.Errorf("%s: users = %v, want %v", tt.name, users, tt.want)
+		}
+		for user, secret := range tt.want {
+			if users[user] != secret {
+				t.Errorf("%s: secret of %s = %q, want %q", tt.name, user, users[user], secret)
+			}
+		}
+	}
+
+	if _, err := LoadAuthFile(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: err = %v", err)
+	}
+}
+
+func TestServeHTTPRejectsUnauthenticated(t *testing.T) {
+	nt := NewNavicatTunnel(nil, nil, NewAuthenticator(map[string]string{"alice": "s3cret"}))
+	want := string(nt.createErrorResponse(202, "tunnel authentication failed"))
+	for _, token := range []string{"", "alice:wrong", "wrong"} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("actn=C&host=db&port=3306&login=root"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			r.Header.Set(TokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		nt.ServeHTTP(w, r)
+		if got := w.Body.String(); got != want {
+			t.Errorf("token %q: response = %q, want %q", token, got, want)
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	a := NewAuthenticator(map[string]string{"alice": "s3cret"})
+	h := a.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}))
+	tests := []struct {
+		name     string
+		basic    []string // user and password, if set
+		target   string
+		wantCode int
+	}{
+		{"no credentials", nil, "/metrics", http.StatusUnauthorized},
+		{"wrong secret", []string{"alice", "wrong"}, "/metrics", http.StatusUnauthorized},
+		{"basic auth", []string{"alice", "s3cret"}, "/metrics", http.StatusOK},
+		{"query token", nil, "/metrics?tunnel_token=s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.basic != nil {
+			r.SetBasicAuth(tt.basic[0], tt.basic[1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if tt.wantCode == http.StatusOK && w.Body.String() != "metrics" {
+			t.Errorf("%s: body = %q", tt.name, w.Body.String())
+		}
+		if tt.wantCode == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// KillTimeout bounds how long the tunnel tries to abort a statement
+const KillTimeout = 10 * time.Second
+
+// QueryCanceler aborts statements running on one upstream connection.
+//
+// Cancelling a context only makes the driver drop its connection; the server
+// keeps executing the statement until it next writes to the client. The
+// canceler issues KILL QUERY over a separate connection instead, so a
+// statement abandoned by the client, or running past its time limit, stops
+// using server resources right away. It also stops the statement of a result
+// set cut short by the result limits, so the rest of its rows need not be
+// read.
+type QueryCanceler struct {
+	params   ConnParams
+	connID   int64
+	onCancel bool // kill statements whose context is done
+}
+
+// newQueryCanceler returns a canceler for conn, or nil if neither killing
+// queries nor a result limit is turned on, or the connection id cannot be
+// read
+func (nt *NavicatTunnel) newQueryCanceler(ctx context.Context, conn *sql.Conn, p ConnParams) *QueryCanceler {
+	limited := nt.ResultLimit.MaxRows > 0 || nt.ResultLimit.MaxBytes > 0 || nt.SpoolMaxSize > 0
+	if !nt.KillOnCancel && !limited {
+		return nil
+	}
+	qc := &QueryCanceler{params: p, onCancel: nt.KillOnCancel}
+	if err := conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&qc.connID); err != nil {
+		return nil
+	}
+	return qc
+}
+
+// Watch kills the running statement if ctx is done before stop is called.
+// stop waits for a kill in progress, so it cannot hit a later statement.
+func (qc *QueryCanceler) Watch(ctx context.Context) (stop func()) {
+	if qc == nil || !qc.onCancel {
+		return func() {}
+	}
+	finished := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			qc.kill(ctx.Err())
+		case <-finished:
+		}
+	}()
+	return func() {
+		close(finished)
+		<-exited
+	}
+}
+
+// kill sends KILL QUERY for the watched connection
+func (qc *QueryCanceler) kill(reason error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), KillTimeout)
+	defer cancel()
+
+	// A connection of its own, so a busy pool cannot hold up the kill
+	db, err := qc.params.Open()
+	if err != nil {
+		log.Printf("killing query on connection %d: %v", qc.connID, err)
+		return err
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", qc.connID)); err != nil {
+		log.Printf("killing query on connection %d: %v", qc.connID, err)
+		return err
+	}
+	log.Printf("killed query on connection %d: %v", qc.connID, reason)
+	return nil
+}
+
+// abortQuery stops the statement whose rows are being read on conn, so the
+// rest of them need not be read. The statement is killed through qc, after
+// which closing the rows only reads those already sent and conn stays
+// usable. Without qc, or if the kill fails, the network connection of conn
+// is closed instead; abortQuery reports false then, and conn cannot run
+// further statements.
+func abortQuery(conn *sql.Conn, qc *QueryCanceler, reason error) bool {
+	if qc != nil && qc.kill(reason) == nil {
+		return true
+	}
+	// Closing the driver connection itself, since database/sql would close
+	// the rows first, reading the rest of them
+	conn.Raw(func(dc interface{}) error {
+		if c, ok := dc.(io.Closer); ok {
+			c.Close()
+		}
+		return nil
+	})
+	return false
+}
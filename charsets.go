@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// charsets are the character sets of MySQL 8.0, utf8 being the old name of
+// utf8mb3
+var charsets = map[string]bool{
+	"armscii8": true, "ascii": true, "big5": true, "binary": true, "cp1250": true, "cp1251": true,
+	"cp1256": true, "cp1257": true, "cp850": true, "cp852": true, "cp866": true, "cp932": true,
+	"dec8": true, "eucjpms": true, "euckr": true, "gb18030": true, "gb2312": true, "gbk": true,
+	"geostd8": true, "greek": true, "hebrew": true, "hp8": true, "keybcs2": true, "koi8r": true,
+	"koi8u": true, "latin1": true, "latin2": true, "latin5": true, "latin7": true, "macce": true,
+	"macroman": true, "sjis": true, "swe7": true, "tis620": true, "ucs2": true, "ujis": true,
+	"utf16": true, "utf16le": true, "utf32": true, "utf8": true, "utf8mb3": true, "utf8mb4": true,
+}
+
+// collations are the collations of MySQL 8.0 with an id below 256, the ones
+// the driver knows, under both names of utf8mb3. Collation names start with
+// the name of their character set.
+var collations = map[string]bool{
+	"armscii8_general_ci": true, "armscii8_bin": true,
+	"ascii_general_ci": true, "ascii_bin": true,
+	"big5_chinese_ci": true, "big5_bin": true,
+	"binary":            true,
+	"cp1250_general_ci": true, "cp1250_czech_cs": true, "cp1250_croatian_ci": true,
+	"cp1250_bin": true, "cp1250_polish_ci": true,
+	"cp1251_bulgarian_ci": true, "cp1251_ukrainian_ci": true, "cp1251_bin": true,
+	"cp1251_general_ci": true, "cp1251_general_cs": true,
+	"cp1256_general_ci": true, "cp1256_bin": true,
+	"cp1257_lithuanian_ci": true, "cp1257_bin": true, "cp1257_general_ci": true,
+	"cp850_general_ci": true, "cp850_bin": true,
+	"cp852_general_ci": true, "cp852_bin": true,
+	"cp866_general_ci": true, "cp866_bin": true,
+	"cp932_japanese_ci": true, "cp932_bin": true,
+	"dec8_swedish_ci": true, "dec8_bin": true,
+	"eucjpms_japanese_ci": true, "eucjpms_bin": true,
+	"euckr_korean_ci": true, "euckr_bin": true,
+	"gb18030_chinese_ci": true, "gb18030_bin": true, "gb18030_unicode_520_ci": true,
+	"gb2312_chinese_ci": true, "gb2312_bin": true,
+	"gbk_chinese_ci": true, "gbk_bin": true,
+	"geostd8_general_ci": true, "geostd8_bin": true,
+	"greek_general_ci": true, "greek_bin": true,
+	"hebrew_general_ci": true, "hebrew_bin": true,
+	"hp8_english_ci": true, "hp8_bin": true,
+	"keybcs2_general_ci": true, "keybcs2_bin": true,
+	"koi8r_general_ci": true, "koi8r_bin": true,
+	"koi8u_general_ci": true, "koi8u_bin": true,
+	"latin1_german1_ci": true, "latin1_swedish_ci": true, "latin1_danish_ci": true,
+	"latin1_german2_ci": true, "latin1_bin": true, "latin1_general_ci": true,
+	"latin1_general_cs": true, "latin1_spanish_ci": true,
+	"latin2_czech_cs": true, "latin2_general_ci": true, "latin2_hungarian_ci": true,
+	"latin2_croatian_ci": true, "latin2_bin": true,
+	"latin5_turkish_ci": true, "latin5_bin": true,
+	"latin7_estonian_cs": true, "latin7_general_ci": true, "latin7_general_cs": true,
+	"latin7_bin":       true,
+	"macce_general_ci": true, "macce_bin": true,
+	"macroman_general_ci": true, "macroman_bin": true,
+	"sjis_japanese_ci": true, "sjis_bin": true,
+	"swe7_swedish_ci": true, "swe7_bin": true,
+	"tis620_thai_ci": true, "tis620_bin": true,
+	"ucs2_general_ci": true, "ucs2_bin": true, "ucs2_unicode_ci": true,
+	"ucs2_icelandic_ci": true, "ucs2_latvian_ci": true, "ucs2_romanian_ci": true,
+	"ucs2_slovenian_ci": true, "ucs2_polish_ci": true, "ucs2_estonian_ci": true,
+	"ucs2_spanish_ci": true, "ucs2_swedish_ci": true, "ucs2_turkish_ci": true,
+	"ucs2_czech_ci": true, "ucs2_danish_ci": true, "ucs2_lithuanian_ci": true,
+	"ucs2_slovak_ci": true, "ucs2_spanish2_ci": true, "ucs2_roman_ci": true,
+	"ucs2_persian_ci": true, "ucs2_esperanto_ci": true, "ucs2_hungarian_ci": true,
+	"ucs2_sinhala_ci": true, "ucs2_german2_ci": true, "ucs2_croatian_ci": true,
+	"ucs2_unicode_520_ci": true, "ucs2_vietnamese_ci": true, "ucs2_general_mysql500_ci": true,
+	"ujis_japanese_ci": true, "ujis_bin": true,
+	"utf16_general_ci": true, "utf16_bin": true, "utf16_unicode_ci": true,
+	"utf16_icelandic_ci": true, "utf16_latvian_ci": true, "utf16_romanian_ci": true,
+	"utf16_slovenian_ci": true, "utf16_polish_ci": true, "utf16_estonian_ci": true,
+	"utf16_spanish_ci": true, "utf16_swedish_ci": true, "utf16_turkish_ci": true,
+	"utf16_czech_ci": true, "utf16_danish_ci": true, "utf16_lithuanian_ci": true,
+	"utf16_slovak_ci": true, "utf16_spanish2_ci": true, "utf16_roman_ci": true,
+	"utf16_persian_ci": true, "utf16_esperanto_ci": true, "utf16_hungarian_ci": true,
+	"utf16_sinhala_ci": true, "utf16_german2_ci": true, "utf16_croatian_ci": true,
+	"utf16_unicode_520_ci": true, "utf16_vietnamese_ci": true,
+	"utf16le_general_ci": true, "utf16le_bin": true,
+	"utf32_general_ci": true, "utf32_bin": true, "utf32_unicode_ci": true,
+	"utf32_icelandic_ci": true, "utf32_latvian_ci": true, "utf32_romanian_ci": true,
+	"utf32_slovenian_ci": true, "utf32_polish_ci": true, "utf32_estonian_ci": true,
+	"utf32_spanish_ci": true, "utf32_swedish_ci": true, "utf32_turkish_ci": true,
+	"utf32_czech_ci": true, "utf32_danish_ci": true, "utf32_lithuanian_ci": true,
+	"utf32_slovak_ci": true, "utf32_spanish2_ci": true, "utf32_roman_ci": true,
+	"utf32_persian_ci": true, "utf32_esperanto_ci": true, "utf32_hungarian_ci": true,
+	"utf32_sinhala_ci": true, "utf32_german2_ci": true, "utf32_croatian_ci": true,
+	"utf32_unicode_520_ci": true, "utf32_vietnamese_ci": true,
+	"utf8_general_ci": true, "utf8_tolower_ci": true, "utf8_bin": true,
+	"utf8_unicode_ci": true, "utf8_icelandic_ci": true, "utf8_latvian_ci": true,
+	"utf8_romanian_ci": true, "utf8_slovenian_ci": true, "utf8_polish_ci": true,
+	"utf8_estonian_ci": true, "utf8_spanish_ci": true, "utf8_swedish_ci": true,
+	"utf8_turkish_ci": true, "utf8_czech_ci": true, "utf8_danish_ci": true,
+	"utf8_lithuanian_ci": true, "utf8_slovak_ci": true, "utf8_spanish2_ci": true,
+	"utf8_roman_ci": true, "utf8_persian_ci": true, "utf8_esperanto_ci": true,
+	"utf8_hungarian_ci": true, "utf8_sinhala_ci": true, "utf8_german2_ci": true,
+	"utf8_croatian_ci": true, "utf8_unicode_520_ci": true, "utf8_vietnamese_ci": true,
+	"utf8_general_mysql500_ci": true,
+	"utf8mb3_general_ci":       true, "utf8mb3_tolower_ci": true, "utf8mb3_bin": true,
+	"utf8mb3_unicode_ci": true, "utf8mb3_icelandic_ci": true, "utf8mb3_latvian_ci": true,
+	"utf8mb3_romanian_ci": true, "utf8mb3_slovenian_ci": true, "utf8mb3_polish_ci": true,
+	"utf8mb3_estonian_ci": true, "utf8mb3_spanish_ci": true, "utf8mb3_swedish_ci": true,
+	"utf8mb3_turkish_ci": true, "utf8mb3_czech_ci": true, "utf8mb3_danish_ci": true,
+	"utf8mb3_lithuanian_ci": true, "utf8mb3_slovak_ci": true, "utf8mb3_spanish2_ci": true,
+	"utf8mb3_roman_ci": true, "utf8mb3_persian_ci": true, "utf8mb3_esperanto_ci": true,
+	"utf8mb3_hungarian_ci": true, "utf8mb3_sinhala_ci": true, "utf8mb3_german2_ci": true,
+	"utf8mb3_croatian_ci": true, "utf8mb3_unicode_520_ci": true, "utf8mb3_vietnamese_ci": true,
+	"utf8mb3_general_mysql500_ci": true,
+	"utf8mb4_general_ci":          true, "utf8mb4_bin": true, "utf8mb4_unicode_ci": true,
+	"utf8mb4_icelandic_ci": true, "utf8mb4_latvian_ci": true, "utf8mb4_romanian_ci": true,
+	"utf8mb4_slovenian_ci": true, "utf8mb4_polish_ci": true, "utf8mb4_estonian_ci": true,
+	"utf8mb4_spanish_ci": true, "utf8mb4_swedish_ci": true, "utf8mb4_turkish_ci": true,
+	"utf8mb4_czech_ci": true, "utf8mb4_danish_ci": true, "utf8mb4_lithuanian_ci": true,
+	"utf8mb4_slovak_ci": true, "utf8mb4_spanish2_ci": true, "utf8mb4_roman_ci": true,
+	"utf8mb4_persian_ci": true, "utf8mb4_esperanto_ci": true, "utf8mb4_hungarian_ci": true,
+	"utf8mb4_sinhala_ci": true, "utf8mb4_german2_ci": true, "utf8mb4_croatian_ci": true,
+	"utf8mb4_unicode_520_ci": true, "utf8mb4_vietnamese_ci": true, "utf8mb4_0900_ai_ci": true,
+}
+
+// validCharset checks a connection character set against the known ones
+func validCharset(name string) error {
+	if charsets[strings.ToLower(name)] {
+		return nil
+	}
+	if collations[strings.ToLower(name)] {
+		return fmt.Errorf("invalid charset %q: it is a collation", name)
+	}
+	return fmt.Errorf("invalid charset %q", name)
+}
+
+// validCollation checks a connection collation against the known ones and
+// the character set it belongs to
+func validCollation(name, charset string) error {
+	coll, cs := strings.ToLower(name), strings.ToLower(charset)
+	if !collations[coll] {
+		return fmt.Errorf("invalid collation %q", name)
+	}
+	owner, _, _ := strings.Cut(coll, "_")
+	if owner == "utf8" {
+		owner = "utf8mb3"
+	}
+	if cs == "utf8" {
+		cs = "utf8mb3"
+	}
+	if owner != cs {
+		return fmt.Errorf("collation %q does not belong to charset %q", name, charset)
+	}
+	return nil
+}
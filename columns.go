@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"runtime/debug"
+)
+
+// MySQLFieldFlag is a bit of the flags word of a column definition
+type MySQLFieldFlag uint32
+
+// MySQL column flags, as in mysql_com.h
+const (
+	NOT_NULL_FLAG         MySQLFieldFlag = 1
+	PRI_KEY_FLAG          MySQLFieldFlag = 2
+	UNIQUE_KEY_FLAG       MySQLFieldFlag = 4
+	MULTIPLE_KEY_FLAG     MySQLFieldFlag = 8
+	BLOB_FLAG             MySQLFieldFlag = 16
+	UNSIGNED_FLAG         MySQLFieldFlag = 32
+	ZEROFILL_FLAG         MySQLFieldFlag = 64
+	BINARY_FLAG           MySQLFieldFlag = 128
+	ENUM_FLAG             MySQLFieldFlag = 256
+	AUTO_INCREMENT_FLAG   MySQLFieldFlag = 512
+	TIMESTAMP_FLAG        MySQLFieldFlag = 1024
+	SET_FLAG              MySQLFieldFlag = 2048
+	NO_DEFAULT_VALUE_FLAG MySQLFieldFlag = 4096
+	ON_UPDATE_NOW_FLAG    MySQLFieldFlag = 8192
+	NUM_FLAG              MySQLFieldFlag = 32768
+)
+
+// BinaryCharset is the collation id of binary strings
+const BinaryCharset = 63
+
+// IsNumericType reports whether values of t are numbers, like IS_NUM in
+// mysql.h
+func IsNumericType(t MySQLFieldType) bool {
+	return (t <= MYSQL_TYPE_INT24 && t != MYSQL_TYPE_TIMESTAMP) ||
+		t == MYSQL_TYPE_YEAR || t == MYSQL_TYPE_NEWDECIMAL
+}
+
+// IsBlobType reports whether t is stored like a BLOB
+func IsBlobType(t MySQLFieldType) bool {
+	switch t {
+	case MYSQL_TYPE_TINY_BLOB, MYSQL_TYPE_MEDIUM_BLOB, MYSQL_TYPE_LONG_BLOB, MYSQL_TYPE_BLOB,
+		MYSQL_TYPE_JSON, MYSQL_TYPE_GEOMETRY:
+		return true
+	}
+	return false
+}
+
+// ColumnMeta describes a result set column as defined by the server
+type ColumnMeta struct {
+	Name     string
+	Table    string // table name or alias the column was selected from
+	Type     MySQLFieldType
+	Flags    MySQLFieldFlag
+	Length   uint32
+	Decimals uint8
+	Charset  uint8 // collation id, 63 for binary data
+}
+
+// driverVersion is the MySQL driver release whose internals DriverColumnMeta
+// and DriverResultCounts read. The tests fail on any other release until its
+// layout has been checked.
+const driverVersion = "v1.7.1"
+
+// driverLayoutKnown reports whether the linked MySQL driver is driverVersion
+var driverLayoutKnown = linkedDriverVersion() == driverVersion
+
+// linkedDriverVersion returns the version of the MySQL driver built into the
+// binary, or "" if it is unknown or replaced by a local copy
+func linkedDriverVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == "github.com/go-sql-driver/mysql" {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// DriverColumnMeta returns the column definitions the MySQL driver received
+// for the current result set of rows.
+//
+// database/sql only exposes a column's name, type name, length and
+// nullability, which is not enough for Navicat to edit a result grid. The
+// driver parses the full column definition packet, so its fields are read
+// here through reflection. The table alias is only kept by the driver when
+// columnsWithAlias is enabled, which connections only do for driverVersion,
+// as it also turns the names database/sql reports into table.column. The
+// driver drops the schema and original table names, which the Navicat field
+// header has no room for anyway. It reports false if rows does not come from
+// a known driver version.
+func DriverColumnMeta(rows *sql.Rows) ([]ColumnMeta, bool) {
+	v := reflect.ValueOf(rows).Elem().FieldByName("rowsi")
+	if !v.IsValid() || v.Kind() != reflect.Interface || v.IsNil() {
+		return nil, false
+	}
+	v = v.Elem()
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	rs := v.FieldByName("rs")
+	if !rs.IsValid() {
+		return nil, false
+	}
+	columns := rs.FieldByName("columns")
+	if !columns.IsValid() || columns.Kind() != reflect.Slice {
+		return nil, false
+	}
+
+	fields := make([]ColumnMeta, columns.Len())
+	for i := range fields {
+		col := columns.Index(i)
+		tableName := col.FieldByName("tableName")
+		name := col.FieldByName("name")
+		length := col.FieldByName("length")
+		flags := col.FieldByName("flags")
+		fieldType := col.FieldByName("fieldType")
+		decimals := col.FieldByName("decimals")
+		charSet := col.FieldByName("charSet")
+		for _, f := range []reflect.Value{tableName, name, length, flags, fieldType, decimals, charSet} {
+			if !f.IsValid() {
+				return nil, false
+			}
+		}
+
+		fields[i] = ColumnMeta{
+			Name:     name.String(),
+			Table:    tableName.String(),
+			Type:     MySQLFieldType(fieldType.Uint()),
+			Flags:    MySQLFieldFlag(flags.Uint()),
+			Length:   uint32(length.Uint()),
+			Decimals: uint8(decimals.Uint()),
+			Charset:  uint8(charSet.Uint()),
+		}
+	}
+	return fields, true
+}
+
+// DriverResultCounts returns the affected rows and insert id of the last OK
+// packet the MySQL driver received on conn. database/sql only reports them
+// for Exec, while statements run as queries, such as CALL and multi-statement
+// queries, end with an OK packet too. The driver keeps its counts on the
+// connection, where they are read through reflection like the column
+// definitions. For several statements they are those of the last one. It
+// reports false if conn does not hold a known driver version's connection.
+func DriverResultCounts(conn *sql.Conn) (affected, insertID uint64, ok bool) {
+	conn.Raw(func(driverConn interface{}) error {
+		v := reflect.ValueOf(driverConn)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		affectedRows := v.Elem().FieldByName("affectedRows")
+		insertId := v.Elem().FieldByName("insertId")
+		if affectedRows.Kind() != reflect.Uint64 || insertId.Kind() != reflect.Uint64 {
+			return nil
+		}
+		affected, insertID, ok = affectedRows.Uint(), insertId.Uint(), true
+		return nil
+	})
+	return affected, insertID, ok
+}
+
+// FieldFlags returns the complete flags word for a column. The flags sent by
+// the server are kept, and the ones implied by the column's type, character
+// set and other flags are added, the way libmysqlclient reports them to
+// clients. This also fills in the flags for columns whose definition was
+// rebuilt from database/sql's column types.
+func FieldFlags(field ColumnMeta) MySQLFieldFlag {
+	flags := field.Flags
+
+	switch field.Type {
+	case MYSQL_TYPE_ENUM:
+		flags |= ENUM_FLAG
+	case MYSQL_TYPE_SET:
+		flags |= SET_FLAG
+	case MYSQL_TYPE_TIMESTAMP:
+		flags |= TIMESTAMP_FLAG
+	}
+	if IsBlobType(field.Type) {
+		flags |= BLOB_FLAG
+	}
+	if IsNumericType(field.Type) {
+		flags |= NUM_FLAG
+	}
+	if field.Charset == BinaryCharset && field.Type != MYSQL_TYPE_NULL {
+		flags |= BINARY_FLAG
+	}
+
+	// Zero filled columns are always unsigned, and key columns of a
+	// primary key are never NULL
+	if flags&ZEROFILL_FLAG != 0 {
+		flags |= UNSIGNED_FLAG
+	}
+	if flags&PRI_KEY_FLAG != 0 {
+		flags |= NOT_NULL_FLAG
+	}
+
+	return flags
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestFieldFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		field ColumnMeta
+		want  MySQLFieldFlag
+	}{
+		{"varchar", ColumnMeta{Type: MYSQL_TYPE_VAR_STRING, Charset: 255}, 0},
+		{"varchar not null", ColumnMeta{Type: MYSQL_TYPE_VAR_STRING, Charset: 255, Flags: NOT_NULL_FLAG}, NOT_NULL_FLAG},
+		{"varbinary", ColumnMeta{Type: MYSQL_TYPE_VAR_STRING, Charset: BinaryCharset}, BINARY_FLAG},
+		{"enum", ColumnMeta{Type: MYSQL_TYPE_ENUM, Charset: 255}, ENUM_FLAG},
+		{"enum sent as string", ColumnMeta{Type: MYSQL_TYPE_STRING, Charset: 255, Flags: ENUM_FLAG}, ENUM_FLAG},
+		{"set", ColumnMeta{Type: MYSQL_TYPE_SET, Charset: 255}, SET_FLAG},
+		{"timestamp", ColumnMeta{Type: MYSQL_TYPE_TIMESTAMP, Charset: BinaryCharset}, TIMESTAMP_FLAG | BINARY_FLAG},
+		{"datetime", ColumnMeta{Type: MYSQL_TYPE_DATETIME, Charset: BinaryCharset}, BINARY_FLAG},
+		{"blob", ColumnMeta{Type: MYSQL_TYPE_BLOB, Charset: BinaryCharset}, BLOB_FLAG | BINARY_FLAG},
+		{"tinyblob", ColumnMeta{Type: MYSQL_TYPE_TINY_BLOB, Charset: BinaryCharset}, BLOB_FLAG | BINARY_FLAG},
+		{"mediumblob", ColumnMeta{Type: MYSQL_TYPE_MEDIUM_BLOB, Charset: BinaryCharset}, BLOB_FLAG | BINARY_FLAG},
+		{"longblob", ColumnMeta{Type: MYSQL_TYPE_LONG_BLOB, Charset: BinaryCharset}, BLOB_FLAG | BINARY_FLAG},
+		{"text", ColumnMeta{Type: MYSQL_TYPE_BLOB, Charset: 255}, BLOB_FLAG},
+		{"json", ColumnMeta{Type: MYSQL_TYPE_JSON, Charset: BinaryCharset}, BLOB_FLAG | BINARY_FLAG},
+		{"geometry", ColumnMeta{Type: MYSQL_TYPE_GEOMETRY, Charset: BinaryCharset}, BLOB_FLAG | BINARY_FLAG},
+		{"tinyint", ColumnMeta{Type: MYSQL_TYPE_TINY, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"smallint", ColumnMeta{Type: MYSQL_TYPE_SHORT, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"mediumint", ColumnMeta{Type: MYSQL_TYPE_INT24, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"int", ColumnMeta{Type: MYSQL_TYPE_LONG, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"bigint", ColumnMeta{Type: MYSQL_TYPE_LONGLONG, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"float", ColumnMeta{Type: MYSQL_TYPE_FLOAT, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"double", ColumnMeta{Type: MYSQL_TYPE_DOUBLE, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"old decimal", ColumnMeta{Type: MYSQL_TYPE_DECIMAL, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"decimal", ColumnMeta{Type: MYSQL_TYPE_NEWDECIMAL, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"year", ColumnMeta{Type: MYSQL_TYPE_YEAR, Charset: BinaryCharset}, NUM_FLAG | BINARY_FLAG},
+		{"bit", ColumnMeta{Type: MYSQL_TYPE_BIT, Charset: BinaryCharset}, BINARY_FLAG},
+		{"null", ColumnMeta{Type: MYSQL_TYPE_NULL, Charset: BinaryCharset}, NUM_FLAG},
+		{"zerofill is unsigned", ColumnMeta{Type: MYSQL_TYPE_LONG, Charset: BinaryCharset, Flags: ZEROFILL_FLAG},
+			ZEROFILL_FLAG | UNSIGNED_FLAG | NUM_FLAG | BINARY_FLAG},
+		{"primary key is not null", ColumnMeta{Type: MYSQL_TYPE_VAR_STRING, Charset: 255, Flags: PRI_KEY_FLAG},
+			PRI_KEY_FLAG | NOT_NULL_FLAG},
+		{"auto increment primary key", ColumnMeta{Type: MYSQL_TYPE_LONG, Charset: BinaryCharset, Flags: PRI_KEY_FLAG | AUTO_INCREMENT_FLAG | UNSIGNED_FLAG},
+			PRI_KEY_FLAG | NOT_NULL_FLAG | AUTO_INCREMENT_FLAG | UNSIGNED_FLAG | NUM_FLAG | BINARY_FLAG},
+		{"unique and multiple keys kept", ColumnMeta{Type: MYSQL_TYPE_VAR_STRING, Charset: 255, Flags: UNIQUE_KEY_FLAG | MULTIPLE_KEY_FLAG},
+			UNIQUE_KEY_FLAG | MULTIPLE_KEY_FLAG},
+		{"server flags kept", ColumnMeta{Type: MYSQL_TYPE_TIMESTAMP, Charset: BinaryCharset, Flags: NOT_NULL_FLAG | ON_UPDATE_NOW_FLAG | NO_DEFAULT_VALUE_FLAG},
+			NOT_NULL_FLAG | ON_UPDATE_NOW_FLAG | NO_DEFAULT_VALUE_FLAG | TIMESTAMP_FLAG | BINARY_FLAG},
+	}
+	for _, tt := range tests {
+		if got := FieldFlags(tt.field); got != tt.want {
+			t.Errorf("%s: FieldFlags = %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDriverColumnMeta(t *testing.T) {
+	server := newFakeMySQL(t)
+	columns := []fakeColumn{
+		{name: "id", table: "u", typ: MYSQL_TYPE_LONG, flags: NOT_NULL_FLAG | PRI_KEY_FLAG | AUTO_INCREMENT_FLAG | UNSIGNED_FLAG, charset: BinaryCharset, length: 10},
+		{name: "name", table: "u", typ: MYSQL_TYPE_VAR_STRING, charset: 28, length: 400},
+		{name: "created", table: "u", typ: MYSQL_TYPE_DATETIME, flags: BINARY_FLAG, charset: BinaryCharset, length: 26, decimals: 6},
+	}
+	server.respond("SELECT * FROM users u", resultSetPackets(columns, [][]*string{{strPtr("1"), nil, strPtr("2024-01-02 03:04:05.000000")}}, 2)...)
+
+	db, err := server.params().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(context.Background(), "SELECT * FROM users u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	fields, ok := DriverColumnMeta(rows)
+	if !ok {
+		t.Fatal("DriverColumnMeta cannot read the driver's column definitions")
+	}
+	want := []ColumnMeta{
+		{Name: "id", Table: "u", Type: MYSQL_TYPE_LONG, Flags: NOT_NULL_FLAG | PRI_KEY_FLAG | AUTO_INCREMENT_FLAG | UNSIGNED_FLAG, Length: 10, Charset: BinaryCharset},
+		{Name: "name", Table: "u", Type: MYSQL_TYPE_VAR_STRING, Length: 400, Charset: 28},
+		{Name: "created", Table: "u", Type: MYSQL_TYPE_DATETIME, Flags: BINARY_FLAG, Length: 26, Decimals: 6, Charset: BinaryCharset},
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("got %d fields, want %d", len(fields), len(want))
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Errorf("field %d = %+v, want %+v", i, fields[i], want[i])
+		}
+	}
+}
+
+func TestDriverVersion(t *testing.T) {
+	if got := linkedDriverVersion(); got != driverVersion {
+		t.Fatalf("MySQL driver %q is linked, but DriverColumnMeta and DriverResultCounts read the internals of %s: check them against the new release and update driverVersion", got, driverVersion)
+	}
+	if !(ConnParams{}).Config().ColumnsWithAlias {
+		t.Error("table aliases not kept for the known driver version")
+	}
+}
+
+func TestDriverResultCounts(t *testing.T) {
+	server := newFakeMySQL(t)
+	columns := []fakeColumn{{name: "v", typ: MYSQL_TYPE_LONG, charset: BinaryCharset, length: 11}}
+	tests := []struct {
+		query    string
+		packets  [][]byte
+		affected uint64
+		insertID uint64
+	}{
+		{"CALL one()", [][]byte{okPacket(3, 9, 2)}, 3, 9},
+		// 0x08 announces more results; the counts are those of the last one
+		{"CALL several()", [][]byte{okPacket(1, 5, 0x0a), okPacket(4, 0, 0x0a), okPacket(2, 11, 2)}, 2, 11},
+		{"CALL rows()", append(resultSetPackets(columns, [][]*string{{strPtr("1")}}, 0x0a), okPacket(6, 8, 2)), 6, 8},
+	}
+	for _, tt := range tests {
+		server.respond(tt.query, tt.packets...)
+	}
+
+	db, err := server.params().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tt := range tests {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := conn.QueryContext(context.Background(), tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			for rows.Next() {
+			}
+			if !rows.NextResultSet() {
+				break
+			}
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+		affected, insertID, ok := DriverResultCounts(conn)
+		if !ok || affected != tt.affected || insertID != tt.insertID {
+			t.Errorf("%s: DriverResultCounts = %d, %d, %v, want %d, %d", tt.query, affected, insertID, ok, tt.affected, tt.insertID)
+		}
+
+		// The tunnel reports the same counts for a query without rows
+		if len(tt.packets) > 0 && tt.packets[0][0] == 0 {
+			nt := &NavicatTunnel{}
+			var buf bytes.Buffer
+			stats, err := nt.HandleQueryExecution(context.Background(), &buf, conn, []string{tt.query}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != 1 || stats[0].Affected != tt.affected {
+				t.Errorf("%s: stats = %+v, want %d rows affected", tt.query, stats, tt.affected)
+			}
+			want := nt.EchoResultSetHeader(0, uint32(tt.affected), uint32(tt.insertID), 0, 0)
+			if !bytes.Contains(buf.Bytes(), want) {
+				t.Errorf("%s: response does not carry the result set header %x", tt.query, want)
+			}
+		}
+		conn.Close()
+	}
+}
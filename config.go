@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// HTTP server defaults
+const (
+	DefaultListen            = ":8000"
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 2 * time.Minute
+	DefaultWriteTimeout      = time.Minute
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultMaxBodySize       = 32 << 20
+	DefaultMaxQueries        = 10000
+)
+
+// Config holds every runtime setting of the tunnel.
+//
+// Settings are applied in this order, later sources overriding earlier ones:
+// built-in defaults, the config file (YAML, TOML or JSON, chosen by its
+// extension), environment variables and finally command line flags.
+type Config struct {
+	Listen   string `json:"listen" yaml:"listen" toml:"listen"`
+	TestMenu bool   `json:"test_menu" yaml:"test_menu" toml:"test_menu"`
+	LogFile  string `json:"log_file" yaml:"log_file" toml:"log_file"` // stderr if empty
+
+	TunnelPath  string `json:"tunnel_path" yaml:"tunnel_path" toml:"tunnel_path"`
+	MetricsPath string `json:"metrics_path" yaml:"metrics_path" toml:"metrics_path"` // off if empty
+	// AdminListen serves metrics and probes on a separate address, if set
+	AdminListen string `json:"admin_listen" yaml:"admin_listen" toml:"admin_listen"`
+
+	// ShutdownDelay keeps serving after a shutdown signal while the
+	// readiness probe fails, ShutdownTimeout then bounds in-flight requests
+	ShutdownDelay   Duration `json:"shutdown_delay" yaml:"shutdown_delay" toml:"shutdown_delay"`
+	ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	HTTP     HTTPSettings     `json:"http" yaml:"http" toml:"http"`
+	TLS      TLSSettings      `json:"tls" yaml:"tls" toml:"tls"`
+	Auth     AuthSettings     `json:"auth" yaml:"auth" toml:"auth"`
+	Audit    AuditSettings    `json:"audit" yaml:"audit" toml:"audit"`
+	Health   HealthSettings   `json:"health" yaml:"health" toml:"health"`
+	Pool     PoolSettings     `json:"pool" yaml:"pool" toml:"pool"`
+	Sessions SessionSettings  `json:"sessions" yaml:"sessions" toml:"sessions"`
+	Targets  TargetSettings   `json:"targets" yaml:"targets" toml:"targets"`
+	Limits   LimitSettings    `json:"limits" yaml:"limits" toml:"limits"`
+	Policy   PolicySettings   `json:"policy" yaml:"policy" toml:"policy"`
+	Results  ResultSettings   `json:"results" yaml:"results" toml:"results"`
+	Upstream UpstreamSettings `json:"upstream" yaml:"upstream" toml:"upstream"`
+}
+
+// HTTPSettings limits how long and how much clients may send and receive
+type HTTPSettings struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout" yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`    // whole request including the body
+	WriteTimeout      Duration `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"` // per write, so streaming may take longer
+	IdleTimeout       Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	MaxBodySizeMB     int      `json:"max_body_size_mb" yaml:"max_body_size_mb" toml:"max_body_size_mb"`
+	MaxQueries        int      `json:"max_queries" yaml:"max_queries" toml:"max_queries"` // per request
+}
+
+// apply sets the server timeouts. The write timeout is applied per write by
+// the tunnel handler instead, since http.Server's covers a whole response.
+func (h HTTPSettings) apply(s *http.Server) {
+	s.ReadHeaderTimeout = time.Duration(h.ReadHeaderTimeout)
+	s.ReadTimeout = time.Duration(h.ReadTimeout)
+	s.IdleTimeout = time.Duration(h.IdleTimeout)
+}
+
+// TLSSettings configures HTTPS serving
+type TLSSettings struct {
+	Cert           string   `json:"cert" yaml:"cert" toml:"cert"`
+	Key            string   `json:"key" yaml:"key" toml:"key"`
+	ClientCA       string   `json:"client_ca" yaml:"client_ca" toml:"client_ca"`
+	ReloadInterval Duration `json:"reload_interval" yaml:"reload_interval" toml:"reload_interval"`
+	RedirectListen string   `json:"redirect_listen" yaml:"redirect_listen" toml:"redirect_listen"`
+}
+
+// AuthSettings configures tunnel credentials
+type AuthSettings struct {
+	Enabled bool   `json:"enabled" yaml:"enabled" toml:"enabled"`
+	File    string `json:"file" yaml:"file" toml:"file"`
+	Token   string `json:"token" yaml:"token" toml:"token"`
+}
+
+// AuditSettings configures the audit log
+type AuditSettings struct {
+	File       string `json:"file" yaml:"file" toml:"file"` // "stdout", or off if empty
+	MaxSizeMB  int    `json:"max_size_mb" yaml:"max_size_mb" toml:"max_size_mb"`
+	MaxBackups int    `json:"max_backups" yaml:"max_backups" toml:"max_backups"`
+	Redact     bool   `json:"redact" yaml:"redact" toml:"redact"` // leave literals out of logged queries
+}
+
+// HealthSettings configures the liveness and readiness probes
+type HealthSettings struct {
+	LivePath     string   `json:"live_path" yaml:"live_path" toml:"live_path"`             // off if empty
+	ReadyPath    string   `json:"ready_path" yaml:"ready_path" toml:"ready_path"`          // off if empty
+	ReadyProfile string   `json:"ready_profile" yaml:"ready_profile" toml:"ready_profile"` // profile pinged by the readiness probe
+	ReadyTimeout Duration `json:"ready_timeout" yaml:"ready_timeout" toml:"ready_timeout"`
+}
+
+// PoolSettings configures upstream connection pools
+type PoolSettings struct {
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	MaxConns    int      `json:"max_conns" yaml:"max_conns" toml:"max_conns"`
+	MaxIdle     int      `json:"max_idle" yaml:"max_idle" toml:"max_idle"`
+	MaxPools    int      `json:"max_pools" yaml:"max_pools" toml:"max_pools"`
+}
+
+// SessionSettings configures session affinity
+type SessionSettings struct {
+	Enabled     bool     `json:"enabled" yaml:"enabled" toml:"enabled"`
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	Max         int      `json:"max" yaml:"max" toml:"max"`
+	MaxPerKey   int      `json:"max_per_key" yaml:"max_per_key" toml:"max_per_key"`
+}
+
+// TargetSettings lists the upstream servers the tunnel may connect to
+type TargetSettings struct {
+	Allow      []string `json:"allow" yaml:"allow" toml:"allow"`
+	Deny       []string `json:"deny" yaml:"deny" toml:"deny"`
+	AllowPorts []string `json:"allow_ports" yaml:"allow_ports" toml:"allow_ports"`
+	DenyPorts  []string `json:"deny_ports" yaml:"deny_ports" toml:"deny_ports"`
+	// AllowLinkLocal lifts the default ban on DefaultDeniedTargets
+	AllowLinkLocal bool `json:"allow_link_local" yaml:"allow_link_local" toml:"allow_link_local"`
+}
+
+// LimitSettings caps request rates and concurrency. Each limit applies to
+// every client address, tunnel user or upstream host on its own.
+type LimitSettings struct {
+	Client LimitRule `json:"client" yaml:"client" toml:"client"`
+	User   LimitRule `json:"user" yaml:"user" toml:"user"`
+	Target LimitRule `json:"target" yaml:"target" toml:"target"`
+}
+
+// PolicySettings limits the statements tunnel users may run. A user with
+// an entry in Users is not subject to Default.
+type PolicySettings struct {
+	Default StatementPolicy            `json:"default" yaml:"default" toml:"default"`
+	Users   map[string]StatementPolicy `json:"users" yaml:"users" toml:"users"`
+}
+
+// ResultSettings limits the result sets sent to clients
+type ResultSettings struct {
+	MaxRows   int    `json:"max_rows" yaml:"max_rows" toml:"max_rows"`          // per result set, off if 0
+	MaxSizeMB int    `json:"max_size_mb" yaml:"max_size_mb" toml:"max_size_mb"` // per result set, off if 0
+	OnLimit   string `json:"on_limit" yaml:"on_limit" toml:"on_limit"`          // "truncate" or "error"
+	// SpoolMaxSizeMB bounds the temporary disk space of one result set,
+	// which is spooled until its row count is known. Larger results fail;
+	// off if 0.
+	SpoolMaxSizeMB int `json:"spool_max_size_mb" yaml:"spool_max_size_mb" toml:"spool_max_size_mb"`
+}
+
+// UpstreamSettings configures connections to MySQL servers
+type UpstreamSettings struct {
+	MultiStatements bool   `json:"multi_statements" yaml:"multi_statements" toml:"multi_statements"`
+	TimeZone        string `json:"time_zone" yaml:"time_zone" toml:"time_zone"`
+	Charset         string `json:"charset" yaml:"charset" toml:"charset"`
+	Collation       string `json:"collation" yaml:"collation" toml:"collation"`
+	TLS             string `json:"tls" yaml:"tls" toml:"tls"`
+	TLSFile         string `json:"tls_file" yaml:"tls_file" toml:"tls_file"`
+	ProfilesFile    string `json:"profiles_file" yaml:"profiles_file" toml:"profiles_file"`
+	RequireProfile  bool   `json:"require_profile" yaml:"require_profile" toml:"require_profile"`
+
+	QueryTimeout Duration `json:"query_timeout" yaml:"query_timeout" toml:"query_timeout"` // per query, none if zero
+	KillOnCancel bool     `json:"kill_on_cancel" yaml:"kill_on_cancel" toml:"kill_on_cancel"`
+}
+
+// DefaultConfig returns the built-in settings
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:     DefaultListen,
+		TestMenu:   true,
+		TunnelPath: "/",
+
+		ShutdownTimeout: Duration(DefaultShutdownTimeout),
+
+		HTTP: HTTPSettings{
+			ReadHeaderTimeout: Duration(DefaultReadHeaderTimeout),
+			ReadTimeout:       Duration(DefaultReadTimeout),
+			WriteTimeout:      Duration(DefaultWriteTimeout),
+			IdleTimeout:       Duration(DefaultIdleTimeout),
+			MaxBodySizeMB:     DefaultMaxBodySize >> 20,
+			MaxQueries:        DefaultMaxQueries,
+		},
+		TLS: TLSSettings{
+			ReloadInterval: Duration(DefaultCertReloadInterval),
+		},
+		Auth: AuthSettings{Enabled: true},
+		Health: HealthSettings{
+			LivePath:     DefaultLivePath,
+			ReadyPath:    DefaultReadyPath,
+			ReadyTimeout: Duration(DefaultReadyTimeout),
+		},
+		Audit: AuditSettings{
+			MaxSizeMB:  DefaultAuditMaxSize >> 20,
+			MaxBackups: DefaultAuditMaxBackups,
+		},
+		Pool: PoolSettings{
+			IdleTimeout: Duration(DefaultPoolIdleTimeout),
+			MaxConns:    DefaultPoolMaxConns,
+			MaxIdle:     DefaultPoolMaxIdle,
+			MaxPools:    DefaultPoolMaxPools,
+		},
+		Sessions: SessionSettings{
+			Enabled:     true,
+			IdleTimeout: Duration(DefaultSessionIdleTimeout),
+			Max:         DefaultMaxSessions,
+			MaxPerKey:   DefaultMaxSessionsPerKey,
+		},
+		Results:  ResultSettings{OnLimit: "truncate"},
+		Upstream: UpstreamSettings{KillOnCancel: true},
+	}
+}
+
+// Duration is a time.Duration written as "90s" or "5m" in config files
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// setting binds a config field to its command line flag and environment
+// variables
+type setting struct {
+	flag  string
+	env   []string
+	usage string
+	value flag.Value
+}
+
+// settings lists the fields of c which flags and environment variables can
+// set
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen", []string{"LISTEN", "PORT"}, "listen address or port", (*stringValue)(&c.Listen)},
+		{"test-menu", []string{"TEST_MENU"}, "serve the test page", (*boolValue)(&c.TestMenu)},
+		{"log-file", []string{"LOG_FILE"}, "append logs to this file instead of stderr", (*stringValue)(&c.LogFile)},
+		{"shutdown-delay", []string{"SHUTDOWN_DELAY"}, "keep serving this long after a shutdown signal while readiness fails", (*Duration)(&c.ShutdownDelay)},
+		{"shutdown-timeout", []string{"SHUTDOWN_TIMEOUT"}, "how long in-flight requests may run after shutdown starts", (*Duration)(&c.ShutdownTimeout)},
+		{"tunnel-path", []string{"TUNNEL_PATH"}, "path of the tunnel endpoint", (*stringValue)(&c.TunnelPath)},
+		{"metrics-path", []string{"METRICS_PATH"}, "path of the Prometheus metrics, such as /metrics; off unless set", (*stringValue)(&c.MetricsPath)},
+		{"admin-listen", []string{"ADMIN_LISTEN"}, "serve metrics and probes on this address instead", (*stringValue)(&c.AdminListen)},
+		{"healthz-path", []string{"HEALTHZ_PATH"}, "path of the liveness probe, empty to turn it off", (*stringValue)(&c.Health.LivePath)},
+		{"readyz-path", []string{"READYZ_PATH"}, "path of the readiness probe, empty to turn it off", (*stringValue)(&c.Health.ReadyPath)},
+		{"ready-profile", []string{"READY_PROFILE"}, "connection profile the readiness probe pings", (*stringValue)(&c.Health.ReadyProfile)},
+		{"ready-timeout", []string{"READY_TIMEOUT"}, "how long the readiness probe waits for MySQL", (*Duration)(&c.Health.ReadyTimeout)},
+
+		{"read-header-timeout", []string{"READ_HEADER_TIMEOUT"}, "time allowed to read request headers", (*Duration)(&c.HTTP.ReadHeaderTimeout)},
+		{"read-timeout", []string{"READ_TIMEOUT"}, "time allowed to read a whole request", (*Duration)(&c.HTTP.ReadTimeout)},
+		{"write-timeout", []string{"WRITE_TIMEOUT"}, "time allowed for each write of a response", (*Duration)(&c.HTTP.WriteTimeout)},
+		{"idle-timeout", []string{"IDLE_TIMEOUT"}, "close keep-alive connections idle for this long", (*Duration)(&c.HTTP.IdleTimeout)},
+		{"max-body-size", []string{"MAX_BODY_SIZE_MB"}, "max request body size in megabytes, 0 for no limit", (*intValue)(&c.HTTP.MaxBodySizeMB)},
+		{"max-queries", []string{"MAX_QUERIES"}, "max queries per request", (*intValue)(&c.HTTP.MaxQueries)},
+
+		{"tls-cert", []string{"TLS_CERT"}, "HTTPS certificate file", (*stringValue)(&c.TLS.Cert)},
+		{"tls-key", []string{"TLS_KEY"}, "HTTPS key file", (*stringValue)(&c.TLS.Key)},
+		{"tls-client-ca", []string{"TLS_CLIENT_CA"}, "require client certificates signed by these CAs", (*stringValue)(&c.TLS.ClientCA)},
+		{"tls-reload-interval", []string{"TLS_RELOAD_INTERVAL"}, "how often to check certificate files for changes", (*Duration)(&c.TLS.ReloadInterval)},
+		{"http-redirect", []string{"HTTP_REDIRECT_LISTEN", "HTTP_REDIRECT_PORT"}, "redirect plain HTTP on this address to HTTPS", (*stringValue)(&c.TLS.RedirectListen)},
+
+		{"auth", []string{"TUNNEL_AUTH"}, "require tunnel credentials", (*boolValue)(&c.Auth.Enabled)},
+		{"auth-file", []string{"TUNNEL_AUTH_FILE"}, "file of user:secret tunnel credentials", (*stringValue)(&c.Auth.File)},
+		{"auth-token", []string{"TUNNEL_TOKEN"}, "tunnel secret of the default user", (*stringValue)(&c.Auth.Token)},
+
+		{"audit-log", []string{"AUDIT_LOG"}, "audit log file, or stdout", (*stringValue)(&c.Audit.File)},
+		{"audit-max-size", []string{"AUDIT_MAX_SIZE_MB"}, "rotate the audit log at this many megabytes", (*intValue)(&c.Audit.MaxSizeMB)},
+		{"audit-max-backups", []string{"AUDIT_MAX_BACKUPS"}, "rotated audit logs kept", (*intValue)(&c.Audit.MaxBackups)},
+		{"audit-redact", []string{"AUDIT_REDACT"}, "leave string and number literals out of logged queries", (*boolValue)(&c.Audit.Redact)},
+
+		{"pool-idle-timeout", []string{"POOL_IDLE_TIMEOUT"}, "close pools unused for this long", (*Duration)(&c.Pool.IdleTimeout)},
+		{"pool-max-conns", []string{"POOL_MAX_CONNS"}, "max open connections per pool", (*intValue)(&c.Pool.MaxConns)},
+		{"pool-max-idle", []string{"POOL_MAX_IDLE"}, "max idle connections per pool", (*intValue)(&c.Pool.MaxIdle)},
+		{"pool-max-pools", []string{"POOL_MAX_POOLS"}, "max pools kept", (*intValue)(&c.Pool.MaxPools)},
+
+		{"sessions", []string{"SESSIONS"}, "pin connections to client sessions", (*boolValue)(&c.Sessions.Enabled)},
+		{"session-idle-timeout", []string{"SESSION_IDLE_TIMEOUT"}, "close sessions unused for this long", (*Duration)(&c.Sessions.IdleTimeout)},
+		{"session-max", []string{"SESSION_MAX"}, "max sessions in total", (*intValue)(&c.Sessions.Max)},
+		{"session-max-per-key", []string{"SESSION_MAX_PER_KEY"}, "max sessions per server and account", (*intValue)(&c.Sessions.MaxPerKey)},
+
+		{"target-allow", []string{"TARGET_ALLOW"}, "MySQL hosts, IPs or CIDRs the tunnel may connect to", (*listValue)(&c.Targets.Allow)},
+		{"target-deny", []string{"TARGET_DENY"}, "MySQL hosts, IPs or CIDRs the tunnel must not connect to", (*listValue)(&c.Targets.Deny)},
+		{"target-allow-ports", []string{"TARGET_ALLOW_PORTS"}, "MySQL ports the tunnel may connect to", (*listValue)(&c.Targets.AllowPorts)},
+		{"target-deny-ports", []string{"TARGET_DENY_PORTS"}, "MySQL ports the tunnel must not connect to", (*listValue)(&c.Targets.DenyPorts)},
+		{"target-allow-link-local", []string{"TARGET_ALLOW_LINK_LOCAL"}, "allow link-local MySQL targets, which are denied by default", (*boolValue)(&c.Targets.AllowLinkLocal)},
+
+		{"limit-client-rate", []string{"LIMIT_CLIENT_RATE"}, "requests per second per client address", (*floatValue)(&c.Limits.Client.Rate)},
+		{"limit-client-burst", []string{"LIMIT_CLIENT_BURST"}, "requests a client address may send at once", (*intValue)(&c.Limits.Client.Burst)},
+		{"limit-client-concurrent", []string{"LIMIT_CLIENT_CONCURRENT"}, "concurrent requests per client address", (*intValue)(&c.Limits.Client.MaxConcurrent)},
+		{"limit-user-rate", []string{"LIMIT_USER_RATE"}, "requests per second per tunnel user", (*floatValue)(&c.Limits.User.Rate)},
+		{"limit-user-burst", []string{"LIMIT_USER_BURST"}, "requests a tunnel user may send at once", (*intValue)(&c.Limits.User.Burst)},
+		{"limit-user-concurrent", []string{"LIMIT_USER_CONCURRENT"}, "concurrent requests per tunnel user", (*intValue)(&c.Limits.User.MaxConcurrent)},
+		{"limit-target-rate", []string{"LIMIT_TARGET_RATE"}, "requests per second per MySQL server", (*floatValue)(&c.Limits.Target.Rate)},
+		{"limit-target-burst", []string{"LIMIT_TARGET_BURST"}, "requests a MySQL server may receive at once", (*intValue)(&c.Limits.Target.Burst)},
+		{"limit-target-concurrent", []string{"LIMIT_TARGET_CONCURRENT"}, "concurrent requests per MySQL server", (*intValue)(&c.Limits.Target.MaxConcurrent)},
+
+		{"policy-allow", []string{"POLICY_ALLOW"}, "statement classes allowed: read, dml, ddl, dcl, admin", (*listValue)(&c.Policy.Default.Allow)},
+		{"policy-deny", []string{"POLICY_DENY"}, "statement classes denied", (*listValue)(&c.Policy.Default.Deny)},
+		{"read-only", []string{"READ_ONLY"}, "run upstream sessions read-only", (*boolValue)(&c.Policy.Default.ReadOnly)},
+
+		{"max-rows", []string{"MAX_ROWS"}, "max rows sent per result set", (*intValue)(&c.Results.MaxRows)},
+		{"max-result-size", []string{"MAX_RESULT_SIZE_MB"}, "max megabytes sent per result set", (*intValue)(&c.Results.MaxSizeMB)},
+		{"spool-max-size", []string{"SPOOL_MAX_SIZE_MB"}, "max megabytes a result set may spool to disk, 0 for no limit", (*intValue)(&c.Results.SpoolMaxSizeMB)},
+		{"on-result-limit", []string{"ON_RESULT_LIMIT"}, "when a result set hits its limit: truncate, or error", (*stringValue)(&c.Results.OnLimit)},
+
+		{"multi-statements", []string{"MULTI_STATEMENTS"}, "allow several statements per query", (*boolValue)(&c.Upstream.MultiStatements)},
+		{"time-zone", []string{"SESSION_TIME_ZONE"}, "session time zone of upstream connections", (*stringValue)(&c.Upstream.TimeZone)},
+		{"charset", []string{"DEFAULT_CHARSET"}, "connection character set if a request names none", (*stringValue)(&c.Upstream.Charset)},
+		{"collation", []string{"DEFAULT_COLLATION"}, "connection collation used along with the default charset", (*stringValue)(&c.Upstream.Collation)},
+		{"upstream-tls", []string{"UPSTREAM_TLS"}, "default upstream TLS config name", (*stringValue)(&c.Upstream.TLS)},
+		{"upstream-tls-file", []string{"UPSTREAM_TLS_FILE"}, "file of named upstream TLS configs", (*stringValue)(&c.Upstream.TLSFile)},
+		{"profiles-file", []string{"PROFILES_FILE"}, "file of connection profiles", (*stringValue)(&c.Upstream.ProfilesFile)},
+		{"require-profile", []string{"REQUIRE_PROFILE"}, "only allow connections through profiles", (*boolValue)(&c.Upstream.RequireProfile)},
+		{"query-timeout", []string{"QUERY_TIMEOUT"}, "max execution time of each query", (*Duration)(&c.Upstream.QueryTimeout)},
+		{"kill-on-cancel", []string{"KILL_ON_CANCEL"}, "KILL QUERY statements whose request is cancelled or times out", (*boolValue)(&c.Upstream.KillOnCancel)},
+	}
+}
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type floatValue float64
+
+func (v *floatValue) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+// boolValue also accepts on/off and yes/no, as in TUNNEL_AUTH=off
+type boolValue bool
+
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+func (v *boolValue) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "on", "yes":
+		*v = true
+	case "off", "no":
+		*v = false
+	default:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		*v = boolValue(b)
+	}
+	return nil
+}
+
+func (d *Duration) String() string     { return time.Duration(*d).String() }
+func (d *Duration) Set(s string) error { return d.UnmarshalText([]byte(s)) }
+
+// listValue is a comma separated list
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+// LoadConfig builds the configuration from defaults, the config file named
+// by -config or CONFIG_FILE, the environment and the command line. It
+// reports whether -print-config was given.
+func LoadConfig(args []string) (cfg *Config, printConfig bool, err error) {
+	// Flags are parsed into a scratch config first, so they can be applied
+	// after the file and environment
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "config file (.yaml, .toml or .json)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	for _, s := range DefaultConfig().settings() {
+		fs.Var(s.value, s.flag, s.usage+" (env "+strings.Join(s.env, ", ")+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg = DefaultConfig()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, false, err
+		}
+	}
+
+	settings := make(map[string]setting)
+	for _, s := range cfg.settings() {
+		settings[s.flag] = s
+		for _, name := range s.env {
+			if v, ok := os.LookupEnv(name); ok {
+				if err := s.value.Set(v); err != nil {
+					return nil, false, fmt.Errorf("%s: %v", name, err)
+				}
+				break
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := settings[f.Name]; ok && err == nil {
+			err = s.value.Set(f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	cfg.Listen = listenAddr(cfg.Listen)
+	if cfg.AdminListen != "" {
+		cfg.AdminListen = listenAddr(cfg.AdminListen)
+	}
+	if cfg.TLS.RedirectListen != "" {
+		cfg.TLS.RedirectListen = listenAddr(cfg.TLS.RedirectListen)
+	}
+	return cfg, printConfig, cfg.Validate()
+}
+
+// loadFile reads settings from a config file, rejecting unknown keys
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(c); err == io.EOF {
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting %q", md.Undecoded()[0].String())
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return fmt.Errorf("%s: unsupported config format, use .yaml, .toml or .json", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen == "" || c.Listen == ":" {
+		add("listen address is empty")
+	}
+	// Paths served by one mux must be distinct
+	mainPaths := map[string]string{}
+	adminPaths := mainPaths
+	if c.AdminListen != "" {
+		adminPaths = map[string]string{}
+	}
+	mount := func(paths map[string]string, name, path string) {
+		switch {
+		case path == "":
+		case !strings.HasPrefix(path, "/"):
+			add("%s %q must start with /", name, path)
+		case paths[path] != "":
+			add("%s %q is already used by %s", name, path, paths[path])
+		default:
+			paths[path] = name
+		}
+	}
+	if c.TunnelPath == "" {
+		add("tunnel_path is empty")
+	}
+	mount(mainPaths, "tunnel_path", c.TunnelPath)
+	mount(adminPaths, "metrics_path", c.MetricsPath)
+	mount(adminPaths, "health live_path", c.Health.LivePath)
+	mount(adminPaths, "health ready_path", c.Health.ReadyPath)
+	if c.Health.ReadyProfile != "" && c.Upstream.ProfilesFile == "" {
+		add("health ready_profile needs an upstream profiles_file")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		add("tls cert and key must be set together")
+	}
+	if c.TLS.Cert == "" && (c.TLS.ClientCA != "" || c.TLS.RedirectListen != "") {
+		add("tls client_ca and redirect_listen need a tls cert and key")
+	}
+	if c.Auth.Enabled && c.Auth.File == "" && c.Auth.Token == "" {
+		add("no tunnel credentials configured: set auth token or file, or turn auth off to run without authentication")
+	}
+
+	durations := []struct {
+		name  string
+		value Duration
+	}{
+		{"shutdown_delay", c.ShutdownDelay},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"http read_header_timeout", c.HTTP.ReadHeaderTimeout},
+		{"http read_timeout", c.HTTP.ReadTimeout},
+		{"http write_timeout", c.HTTP.WriteTimeout},
+		{"http idle_timeout", c.HTTP.IdleTimeout},
+		{"tls reload_interval", c.TLS.ReloadInterval},
+		{"health ready_timeout", c.Health.ReadyTimeout},
+		{"pool idle_timeout", c.Pool.IdleTimeout},
+		{"sessions idle_timeout", c.Sessions.IdleTimeout},
+		{"upstream query_timeout", c.Upstream.QueryTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			add("%s must not be negative", d.name)
+		}
+	}
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"http max_body_size_mb", c.HTTP.MaxBodySizeMB},
+		{"http max_queries", c.HTTP.MaxQueries},
+		{"audit max_size_mb", c.Audit.MaxSizeMB},
+		{"audit max_backups", c.Audit.MaxBackups},
+		{"pool max_conns", c.Pool.MaxConns},
+		{"pool max_idle", c.Pool.MaxIdle},
+		{"pool max_pools", c.Pool.MaxPools},
+		{"sessions max", c.Sessions.Max},
+		{"sessions max_per_key", c.Sessions.MaxPerKey},
+		{"results max_rows", c.Results.MaxRows},
+		{"results max_size_mb", c.Results.MaxSizeMB},
+		{"results spool_max_size_mb", c.Results.SpoolMaxSizeMB},
+		{"limits client burst", c.Limits.Client.Burst},
+		{"limits client max_concurrent", c.Limits.Client.MaxConcurrent},
+		{"limits user burst", c.Limits.User.Burst},
+		{"limits user max_concurrent", c.Limits.User.MaxConcurrent},
+		{"limits target burst", c.Limits.Target.Burst},
+		{"limits target max_concurrent", c.Limits.Target.MaxConcurrent},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			add("%s must not be negative", l.name)
+		}
+	}
+	rates := []struct {
+		name  string
+		value float64
+	}{
+		{"limits client rate", c.Limits.Client.Rate},
+		{"limits user rate", c.Limits.User.Rate},
+		{"limits target rate", c.Limits.Target.Rate},
+	}
+	for _, r := range rates {
+		if r.value < 0 || math.IsNaN(r.value) || math.IsInf(r.value, 0) {
+			add("%s must be a non-negative number", r.name)
+		}
+	}
+
+	if c.Results.OnLimit != "truncate" && c.Results.OnLimit != "error" {
+		add("results on_limit must be truncate or error, not %q", c.Results.OnLimit)
+	}
+	if err := c.Policy.Default.Validate(); err != nil {
+		add("policy default: %v", err)
+	}
+	users := make([]string, 0, len(c.Policy.Users))
+	for user := range c.Policy.Users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		sp := c.Policy.Users[user]
+		if err := sp.Validate(); err != nil {
+			add("policy users %s: %v", user, err)
+		}
+	}
+
+	if _, err := c.TargetPolicy(); err != nil {
+		add("targets: %v", err)
+	}
+	if err := (ConnParams{Charset: c.Upstream.Charset, Collation: c.Upstream.Collation}).Validate(); err != nil {
+		add("upstream: %v", err)
+	}
+	if c.Upstream.RequireProfile && c.Upstream.ProfilesFile == "" {
+		add("upstream require_profile needs a profiles_file")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// TargetPolicy builds the upstream target policy
+func (c *Config) TargetPolicy() (*TargetPolicy, error) {
+	t := c.Targets
+	return NewTargetPolicy(strings.Join(t.Allow, ","), strings.Join(t.Deny, ","),
+		strings.Join(t.AllowPorts, ","), strings.Join(t.DenyPorts, ","), t.AllowLinkLocal)
+}
+
+// PoolOptions returns the pool settings
+func (c *Config) PoolOptions() PoolOptions {
+	return PoolOptions{
+		IdleTimeout: time.Duration(c.Pool.IdleTimeout),
+		MaxConns:    c.Pool.MaxConns,
+		MaxIdle:     c.Pool.MaxIdle,
+		MaxPools:    c.Pool.MaxPools,
+	}
+}
+
+// SessionOptions returns the session settings
+func (c *Config) SessionOptions() SessionOptions {
+	return SessionOptions{
+		Enabled:     c.Sessions.Enabled,
+		IdleTimeout: time.Duration(c.Sessions.IdleTimeout),
+		MaxSessions: c.Sessions.Max,
+		MaxPerKey:   c.Sessions.MaxPerKey,
+	}
+}
+
+// StatementPolicies returns the default statement policy and those of
+// tunnel users
+func (c *Config) StatementPolicies() (*StatementPolicy, map[string]*StatementPolicy) {
+	def := c.Policy.Default
+	users := make(map[string]*StatementPolicy, len(c.Policy.Users))
+	for user, sp := range c.Policy.Users {
+		sp := sp
+		users[user] = &sp
+	}
+	return &def, users
+}
+
+// ResultLimit returns the result set limits
+func (c *Config) ResultLimit() ResultLimit {
+	return ResultLimit{
+		MaxRows:  c.Results.MaxRows,
+		MaxBytes: int64(c.Results.MaxSizeMB) << 20,
+		Fail:     c.Results.OnLimit == "error",
+	}
+}
+
+// RequestLimits builds the request limiters
+func (c *Config) RequestLimits() Limits {
+	return Limits{
+		Client: NewLimiter("client", c.Limits.Client),
+		User:   NewLimiter("user", c.Limits.User),
+		Target: NewLimiter("target", c.Limits.Target),
+	}
+}
+
+// Print writes the configuration as YAML with secrets masked
+func (c *Config) Print(w io.Writer) error {
+	masked := *c
+	if masked.Auth.Token != "" {
+		masked.Auth.Token = "********"
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&masked); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file named name into a temporary directory
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{"yaml", "tunnel.yaml", `
+listen: ":9000"
+auth:
+  token: s3cret
+pool:
+  max_conns: 5
+upstream:
+  query_timeout: 30s
+policy:
+  users:
+    alice:
+      allow: [read]
+`, ""},
+		{"toml", "tunnel.toml", `
+listen = ":9000"
+[auth]
+token = "s3cret"
+[pool]
+max_conns = 5
+[upstream]
+query_timeout = "30s"
+[policy.users.alice]
+allow = ["read"]
+`, ""},
+		{"json", "tunnel.json", `{
+  "listen": ":9000",
+  "auth": {"token": "s3cret"},
+  "pool": {"max_conns": 5},
+  "upstream": {"query_timeout": "30s"},
+  "policy": {"users": {"alice": {"allow": ["read"]}}}
+}`, ""},
+		{"yaml unknown key", "tunnel.yml", "auth:\n  token: s3cret\npool:\n  max_conn: 5\n", "field max_conn not found"},
+		{"toml unknown key", "tunnel.toml", "[auth]\ntoken = \"s3cret\"\n[pool]\nmax_conn = 5\n", `unknown setting "pool.max_conn"`},
+		{"json unknown key", "tunnel.json", `{"auth": {"token": "s3cret"}, "pool": {"max_conn": 5}}`, `unknown field "max_conn"`},
+		{"yaml bad duration", "tunnel.yaml", "auth:\n  token: s3cret\nupstream:\n  query_timeout: soon\n", "soon"},
+		{"json syntax", "tunnel.json", `{"auth": `, "unexpected EOF"},
+		{"unsupported format", "tunnel.ini", "listen = :9000\n", "unsupported config format"},
+	}
+	for _, tt := range tests {
+		path := writeConfig(t, tt.file, tt.content)
+		cfg, _, err := LoadConfig([]string{"-config", path})
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want one containing %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cfg.Listen != ":9000" || cfg.Auth.Token != "s3cret" || cfg.Pool.MaxConns != 5 ||
+			time.Duration(cfg.Upstream.QueryTimeout) != 30*time.Second {
+			t.Errorf("%s: settings not loaded: %+v", tt.name, cfg)
+		}
+		if sp := cfg.Policy.Users["alice"]; len(sp.Allow) != 1 || sp.Allow[0] != "read" {
+			t.Errorf("%s: policy of alice = %+v", tt.name, sp)
+		}
+		// Settings the file leaves out keep their defaults
+		if cfg.Pool.MaxIdle != DefaultPoolMaxIdle || !cfg.Upstream.KillOnCancel {
+			t.Errorf("%s: defaults not kept: %+v", tt.name, cfg)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "tunnel.yaml", "auth:\n  token: s3cret\npool:\n  max_conns: 5\n  max_idle: 3\nsessions:\n  max: 50\n")
+	t.Setenv("POOL_MAX_CONNS", "7")
+	t.Setenv("POOL_MAX_IDLE", "4")
+
+	cfg, _, err := LoadConfig([]string{"-config", path, "-pool-max-idle", "2", "-listen", "9100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Sessions.Max != 50 {
+		t.Errorf("sessions max = %d, want the file's 50", cfg.Sessions.Max)
+	}
+	if cfg.Pool.MaxConns != 7 {
+		t.Errorf("pool max_conns = %d, want the environment's 7", cfg.Pool.MaxConns)
+	}
+	if cfg.Pool.MaxIdle != 2 {
+		t.Errorf("pool max_idle = %d, want the flag's 2", cfg.Pool.MaxIdle)
+	}
+	if cfg.Listen != ":9100" {
+		t.Errorf("listen = %q, want a bare port turned into an address", cfg.Listen)
+	}
+
+	t.Setenv("POOL_MAX_CONNS", "many")
+	if _, _, err := LoadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "POOL_MAX_CONNS") {
+		t.Errorf("invalid environment value: err = %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{"defaults with a token", func(c *Config) {}, ""},
+		{"no credentials", func(c *Config) { c.Auth.Token = "" }, "no tunnel credentials configured"},
+		{"auth off", func(c *Config) { c.Auth.Token, c.Auth.Enabled = "", false }, ""},
+		{"negative limit", func(c *Config) { c.Pool.MaxConns = -1 }, "pool max_conns must not be negative"},
+		{"negative duration", func(c *Config) { c.Upstream.QueryTimeout = Duration(-time.Second) }, "upstream query_timeout must not be negative"},
+		{"negative rate", func(c *Config) { c.Limits.User.Rate = -1 }, "limits user rate must be a non-negative number"},
+		{"on_limit", func(c *Config) { c.Results.OnLimit = "drop" }, `results on_limit must be truncate or error, not "drop"`},
+		{"default policy class", func(c *Config) { c.Policy.Default.Allow = []string{"write"} }, `policy default: unknown statement class "write"`},
+		{"user policy class", func(c *Config) {
+			c.Policy.Users = map[string]StatementPolicy{"alice": {Deny: []string{"ddl", "drop"}}}
+		}, `policy users alice: unknown statement class "drop"`},
+		{"relative path", func(c *Config) { c.MetricsPath = "metrics" }, `metrics_path "metrics" must start with /`},
+		{"path used twice", func(c *Config) { c.MetricsPath, c.Health.LivePath = "/metrics", "/metrics" }, "is already used by metrics_path"},
+		{"paths on the admin listener", func(c *Config) {
+			c.AdminListen = ":9090"
+			c.MetricsPath, c.TunnelPath = "/metrics", "/metrics"
+		}, ""},
+		{"half a certificate", func(c *Config) { c.TLS.Cert = "cert.pem" }, "tls cert and key must be set together"},
+		{"ready profile without profiles", func(c *Config) { c.Health.ReadyProfile = "main" }, "health ready_profile needs an upstream profiles_file"},
+		{"target CIDR", func(c *Config) { c.Targets.Allow = []string{"10.0.0.0/33"} }, "targets:"},
+		{"charset", func(c *Config) { c.Upstream.Charset = "utf8;" }, "upstream:"},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig()
+		c.Auth.Token = "s3cret"
+		tt.modify(c)
+		err := c.Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Every problem is reported at once
+	c := DefaultConfig()
+	c.Pool.MaxConns = -1
+	c.Results.OnLimit = "drop"
+	err := c.Validate()
+	if err == nil || strings.Count(err.Error(), "\n  ") != 3 {
+		t.Errorf("err = %v, want the missing credentials and both invalid settings", err)
+	}
+}
@@ -1,5 +1,9 @@
 module navicat-tunnel
 
-go 1.19
+go 1.21
 
-require github.com/go-sql-driver/mysql v1.7.1
\ No newline at end of file
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/go-sql-driver/mysql v1.7.1
+	gopkg.in/yaml.v3 v3.0.1
+)
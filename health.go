@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Health endpoint defaults
+const (
+	DefaultLivePath     = "/healthz"
+	DefaultReadyPath    = "/readyz"
+	DefaultReadyTimeout = 5 * time.Second
+)
+
+// Health serves liveness and readiness probes. Readiness optionally
+// requires a MySQL server to answer a ping.
+type Health struct {
+	pools   *PoolManager
+	target  *ConnParams // pinged by the readiness probe, if set
+	timeout time.Duration
+	// draining is set once shutdown starts
+	draining atomic.Bool
+}
+
+// NewHealth creates the probe handlers. target may be nil.
+func NewHealth(pools *PoolManager, target *ConnParams, timeout time.Duration) *Health {
+	return &Health{pools: pools, target: target, timeout: timeout}
+}
+
+// healthResponse is the JSON body of both probes
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Live reports that the process is up and serving
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Ready reports whether the tunnel should receive traffic
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok", Checks: make(map[string]string)}
+	code := http.StatusOK
+
+	if h.draining.Load() {
+		resp.Checks["server"] = "shutting down"
+		code = http.StatusServiceUnavailable
+	}
+	if h.target != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+		defer cancel()
+		_, release, err := h.pools.Acquire(ctx, *h.target)
+		if err != nil {
+			resp.Checks["mysql"] = err.Error()
+			code = http.StatusServiceUnavailable
+		} else {
+			release()
+			resp.Checks["mysql"] = "ok"
+		}
+	}
+
+	if code != http.StatusOK {
+		resp.Status = "unavailable"
+	}
+	writeHealth(w, code, resp)
+}
+
+// SetDraining makes the readiness probe fail from now on, so load balancers
+// stop sending requests while in-flight ones finish
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limiterSweepInterval is how often idle limiter entries are dropped
+const limiterSweepInterval = time.Minute
+
+// LimitRule is a token bucket refilled at Rate requests per second holding
+// up to Burst tokens, plus a cap on concurrent requests. Zero values turn
+// the respective limit off.
+type LimitRule struct {
+	Rate          float64 `json:"rate" yaml:"rate" toml:"rate"`
+	Burst         int     `json:"burst" yaml:"burst" toml:"burst"`
+	MaxConcurrent int     `json:"max_concurrent" yaml:"max_concurrent" toml:"max_concurrent"`
+}
+
+// enabled reports whether the rule limits anything
+func (r LimitRule) enabled() bool {
+	return r.Rate > 0 || r.MaxConcurrent > 0
+}
+
+type limitEntry struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// Limiter applies a LimitRule to each key, such as a client address, on its
+// own. A nil *Limiter allows everything.
+type Limiter struct {
+	scope     string
+	rule      LimitRule
+	mu        sync.Mutex
+	entries   map[string]*limitEntry
+	lastSweep time.Time
+	rejected  map[string]uint64 // by reason
+}
+
+// NewLimiter creates a limiter for rule, or returns nil if the rule limits
+// nothing. scope names the keys in errors and metrics.
+func NewLimiter(scope string, rule LimitRule) *Limiter {
+	if !rule.enabled() {
+		return nil
+	}
+	if rule.Rate > 0 && rule.Burst < 1 {
+		rule.Burst = int(math.Ceil(rule.Rate))
+	}
+	return &Limiter{
+		scope:     scope,
+		rule:      rule,
+		entries:   make(map[string]*limitEntry),
+		lastSweep: time.Now(),
+		rejected:  make(map[string]uint64),
+	}
+}
+
+// LimitError reports a request refused by a limiter
+type LimitError struct {
+	Scope      string
+	Key        string
+	Reason     string // "rate" or "concurrency"
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	what := "request rate limit"
+	if e.Reason == "concurrency" {
+		what = "concurrent request limit"
+	}
+	return fmt.Sprintf("%s reached for %s %s, retry after %s", what, e.Scope, e.Key, e.RetryAfter)
+}
+
+// Acquire takes a token and a concurrency slot for key. The returned release
+// function frees the slot once the request is done.
+func (l *Limiter) Acquire(key string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		l.sweep(now)
+	}
+	e := l.entries[key]
+	if e == nil {
+		e = &limitEntry{tokens: float64(l.rule.Burst), last: now}
+		l.entries[key] = e
+	}
+
+	if l.rule.MaxConcurrent > 0 && e.active >= l.rule.MaxConcurrent {
+		l.rejected["concurrency"]++
+		return nil, &LimitError{Scope: l.scope, Key: key, Reason: "concurrency", RetryAfter: time.Second}
+	}
+	if l.rule.Rate > 0 {
+		e.tokens = math.Min(float64(l.rule.Burst), e.tokens+now.Sub(e.last).Seconds()*l.rule.Rate)
+		e.last = now
+		if e.tokens < 1 {
+			l.rejected["rate"]++
+			wait := time.Duration((1 - e.tokens) / l.rule.Rate * float64(time.Second))
+			return nil, &LimitError{Scope: l.scope, Key: key, Reason: "rate", RetryAfter: wait.Round(time.Millisecond)}
+		}
+		e.tokens--
+	}
+	e.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			e.active--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// sweep drops entries without requests in flight whose bucket is full
+// again. The caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, e := range l.entries {
+		full := l.rule.Rate <= 0 || e.tokens+now.Sub(e.last).Seconds()*l.rule.Rate >= float64(l.rule.Burst)
+		if e.active == 0 && full {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// stats returns the number of tracked keys, requests in flight and
+// rejections by reason
+func (l *Limiter) stats() (keys, active int, rejected map[string]uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rejected = make(map[string]uint64, len(l.rejected))
+	for reason, n := range l.rejected {
+		rejected[reason] = n
+	}
+	for _, e := range l.entries {
+		active += e.active
+	}
+	return len(l.entries), active, rejected
+}
+
+// Limits holds the limiters of each scope
+type Limits struct {
+	Client *Limiter // by remote IP address
+	User   *Limiter // by tunnel user
+	Target *Limiter // by upstream host and port
+}
+
+// Acquire takes a slot from each limiter in turn, releasing the ones already
+// taken if a later limiter refuses the request. An empty key skips its
+// limiter.
+func (ls Limits) Acquire(client, user, target string) (release func(), err error) {
+	var releases []func()
+	release = func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, k := range []struct {
+		l   *Limiter
+		key string
+	}{{ls.Client, client}, {ls.User, user}, {ls.Target, target}} {
+		if k.key == "" {
+			continue
+		}
+		r, err := k.l.Acquire(k.key)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+// WriteMetrics writes the limiter state
+func (ls Limits) WriteMetrics(w io.Writer) {
+	var limiters []*Limiter
+	for _, l := range []*Limiter{ls.Client, ls.User, ls.Target} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	if len(limiters) == 0 {
+		return
+	}
+	type limiterStats struct {
+		keys, active int
+		rejected     map[string]uint64
+	}
+	stats := make([]limiterStats, len(limiters))
+	for i, l := range limiters {
+		stats[i].keys, stats[i].active, stats[i].rejected = l.stats()
+	}
+
+	fmt.Fprintf(w, "# HELP ntunnel_limiter_keys Clients, users or targets tracked by each limiter.\n# TYPE ntunnel_limiter_keys gauge\n")
+	for i, l := range limiters {
+		fmt.Fprintf(w, "ntunnel_limiter_keys%s %d\n", labelPairs([]string{"scope"}, []string{l.scope}), stats[i].keys)
+	}
+	fmt.Fprintf(w, "# HELP ntunnel_limiter_active_requests Requests in flight counted by each limiter.\n# TYPE ntunnel_limiter_active_requests gauge\n")
+	for i, l := range limiters {
+		fmt.Fprintf(w, "ntunnel_limiter_active_requests%s %d\n", labelPairs([]string{"scope"}, []string{l.scope}), stats[i].active)
+	}
+	fmt.Fprintf(w, "# HELP ntunnel_limiter_rejections_total Requests refused by each limiter.\n# TYPE ntunnel_limiter_rejections_total counter\n")
+	for i, l := range limiters {
+		for _, reason := range []string{"concurrency", "rate"} {
+			labels := labelPairs([]string{"scope", "reason"}, []string{l.scope, reason})
+			fmt.Fprintf(w, "ntunnel_limiter_rejections_total%s %d\n", labels, stats[i].rejected[reason])
+		}
+	}
+}
+
+// clientIP returns the address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurst(t *testing.T) {
+	l := NewLimiter("client", LimitRule{Rate: 1, Burst: 3})
+	for i := 0; i < 3; i++ {
+		release, err := l.Acquire("10.0.0.1")
+		if err != nil {
+			t.Fatalf("request %d within the burst: %v", i+1, err)
+		}
+		release()
+	}
+
+	_, err := l.Acquire("10.0.0.1")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Reason != "rate" || limitErr.Scope != "client" || limitErr.Key != "10.0.0.1" {
+		t.Fatalf("request beyond the burst: err = %v, want a rate limit error", err)
+	}
+	if limitErr.RetryAfter <= 0 || limitErr.RetryAfter > time.Second {
+		t.Errorf("RetryAfter = %s, want up to a second", limitErr.RetryAfter)
+	}
+
+	// Keys have buckets of their own
+	if _, err := l.Acquire("10.0.0.2"); err != nil {
+		t.Errorf("other key: %v", err)
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := NewLimiter("user", LimitRule{Rate: 2, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := l.Acquire("alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := l.Acquire("alice"); err == nil {
+		t.Fatal("bucket not empty after the burst")
+	}
+
+	// Half a second at 2 per second refills one token
+	l.entries["alice"].last = l.entries["alice"].last.Add(-500 * time.Millisecond)
+	if _, err := l.Acquire("alice"); err != nil {
+		t.Fatalf("after refilling one token: %v", err)
+	}
+	if _, err := l.Acquire("alice"); err == nil {
+		t.Fatal("refilled more than one token")
+	}
+
+	// The bucket never holds more than the burst
+	l.entries["alice"].last = l.entries["alice"].last.Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := l.Acquire("alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := l.Acquire("alice"); err == nil {
+		t.Error("bucket refilled beyond the burst")
+	}
+}
+
+func TestLimiterDefaultBurst(t *testing.T) {
+	l := NewLimiter("client", LimitRule{Rate: 2.5})
+	if l.rule.Burst != 3 {
+		t.Errorf("Burst = %d, want the rate rounded up", l.rule.Burst)
+	}
+	if NewLimiter("client", LimitRule{Burst: 5}) != nil {
+		t.Error("limiter created for a rule without rate or concurrency limit")
+	}
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := NewLimiter("target", LimitRule{MaxConcurrent: 1})
+	release, err := l.Acquire("db:3306")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Acquire("db:3306")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Reason != "concurrency" {
+		t.Fatalf("second concurrent request: err = %v, want a concurrency limit error", err)
+	}
+	release()
+	release() // releasing twice frees one slot only
+	if _, err := l.Acquire("db:3306"); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+	if _, err := l.Acquire("db:3306"); err == nil {
+		t.Error("slot freed twice")
+	}
+}
+
+func TestLimitsAcquireReleasesOnRejection(t *testing.T) {
+	ls := Limits{
+		Client: NewLimiter("client", LimitRule{MaxConcurrent: 1}),
+		User:   NewLimiter("user", LimitRule{MaxConcurrent: 1}),
+	}
+	hold, err := ls.Acquire("", "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client slot taken before the user limiter refuses is given back
+	if _, err := ls.Acquire("10.0.0.1", "alice", "db:3306"); err == nil {
+		t.Fatal("user limit not applied")
+	}
+	hold()
+	if _, err := ls.Acquire("10.0.0.1", "alice", "db:3306"); err != nil {
+		t.Errorf("client slot still held after a rejection: %v", err)
+	}
+}
+
+func TestServeHTTPRejectsLimited(t *testing.T) {
+	nt := NewNavicatTunnel(nil, nil, nil)
+	nt.Limits.Client = NewLimiter("client", LimitRule{Rate: 0.5, Burst: 1})
+	// An earlier request took the only token
+	nt.Limits.Client.Acquire("192.0.2.1")
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("actn=C&host=db&port=3306&login=root"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	nt.ServeHTTP(w, r)
+
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want %q", got, "2")
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, string(nt.EchoHeader(202))) || !strings.Contains(body, "request rate limit reached for client 192.0.2.1, retry after ") {
+		t.Errorf("response = %q, want a rate limit error block", body)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// QueryDurationBuckets are the upper bounds of the query duration histogram
+// in seconds
+var QueryDurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// series is one labelled value of a metric
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // histogram buckets
+	count  uint64
+}
+
+// metricVec is a counter or histogram with labels, written in the Prometheus
+// text format
+type metricVec struct {
+	name    string
+	help    string
+	kind    string // "counter" or "histogram"
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*series
+}
+
+func newMetricVec(name, help, kind string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		// Show zero before the first sample
+		m.get(nil)
+	}
+	return m
+}
+
+// get returns the series for the label values. The caller must hold m.mu.
+func (m *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: values, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add increases a counter
+func (m *metricVec) Add(v float64, values ...string) {
+	m.mu.Lock()
+	m.get(values).value += v
+	m.mu.Unlock()
+}
+
+// Observe records a histogram sample
+func (m *metricVec) Observe(v float64, values ...string) {
+	m.mu.Lock()
+	s := m.get(values)
+	for i, le := range m.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labelPairs(m.labels, s.labels), formatValue(s.value))
+			continue
+		}
+		names := append(m.labels[:len(m.labels):len(m.labels)], "le")
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelPairs(names, append(s.labels[:len(s.labels):len(s.labels)], formatValue(le))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelPairs(names, append(s.labels[:len(s.labels):len(s.labels)], "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelPairs(m.labels, s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelPairs(m.labels, s.labels), s.count)
+	}
+}
+
+// labelPairs formats {name="value",...}
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeSample writes a metric whose value is read at scrape time
+func writeSample(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatValue(value))
+}
+
+// Metrics collects the tunnel's Prometheus metrics. A nil *Metrics records
+// nothing.
+type Metrics struct {
+	requests      *metricVec
+	queryDuration *metricVec
+	bytesSent     *metricVec
+	rowsStreamed  *metricVec
+	truncated     *metricVec
+
+	mu         sync.Mutex
+	collectors []func(w io.Writer)
+}
+
+// NewMetrics creates the tunnel metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newMetricVec("ntunnel_requests_total",
+			"Tunnel requests by action and status.", "counter", nil, "action", "status"),
+		queryDuration: newMetricVec("ntunnel_query_duration_seconds",
+			"Query execution time including streaming the result.", "histogram", QueryDurationBuckets, "status"),
+		bytesSent: newMetricVec("ntunnel_response_bytes_total",
+			"Bytes of tunnel responses sent to clients.", "counter", nil),
+		rowsStreamed: newMetricVec("ntunnel_rows_streamed_total",
+			"Result rows sent to clients.", "counter", nil),
+		truncated: newMetricVec("ntunnel_truncated_results_total",
+			"Queries whose result sets were cut short by the result limit.", "counter", nil),
+	}
+}
+
+// statusLabel names a tunnel error code for the status label
+func statusLabel(errno uint32) string {
+	if errno == 0 {
+		return "ok"
+	}
+	return "error"
+}
+
+// actionLabel names a request action for the action label. Anything but the
+// known actions is "invalid", so clients can't create new series.
+func actionLabel(action string) string {
+	switch action {
+	case "C", "Q":
+		return action
+	}
+	return "invalid"
+}
+
+// ObserveRequest counts a finished tunnel request and its response size
+func (m *Metrics) ObserveRequest(action string, errno uint32, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.requests.Add(1, actionLabel(action), statusLabel(errno))
+	m.bytesSent.Add(float64(bytes))
+}
+
+// ObserveQuery records a query's duration and the rows it sent
+func (m *Metrics) ObserveQuery(st QueryStats) {
+	if m == nil {
+		return
+	}
+	m.queryDuration.Observe(st.Duration.Seconds(), statusLabel(st.ErrorCode))
+	m.rowsStreamed.Add(float64(st.Rows))
+	if st.Truncated {
+		m.truncated.Add(1)
+	}
+}
+
+// Collect registers a function which writes metrics read at scrape time
+func (m *Metrics) Collect(f func(w io.Writer)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.collectors = append(m.collectors, f)
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, vec := range []*metricVec{m.requests, m.queryDuration, m.bytesSent, m.rowsStreamed, m.truncated} {
+		vec.write(w)
+	}
+	m.mu.Lock()
+	collectors := m.collectors
+	m.mu.Unlock()
+	for _, collect := range collectors {
+		collect(w)
+	}
+}
+
+// WritePoolMetrics writes the pool manager's statistics
+func (pm *PoolManager) WritePoolMetrics(w io.Writer) {
+	pools, stats, failures := pm.Stats()
+	writeSample(w, "ntunnel_pools", "gauge", "Upstream connection pools open.", float64(pools))
+	writeSample(w, "ntunnel_upstream_connect_failures_total", "counter", "Failed attempts to connect to an upstream server.", float64(failures))
+	writeSample(w, "ntunnel_pool_max_open_connections", "gauge", "Max open connections over all pools.", float64(stats.MaxOpenConnections))
+	writeSample(w, "ntunnel_pool_open_connections", "gauge", "Open upstream connections.", float64(stats.OpenConnections))
+	writeSample(w, "ntunnel_pool_in_use_connections", "gauge", "Upstream connections in use.", float64(stats.InUse))
+	writeSample(w, "ntunnel_pool_idle_connections", "gauge", "Idle upstream connections.", float64(stats.Idle))
+	writeSample(w, "ntunnel_pool_wait_count_total", "counter", "Waits for a free upstream connection.", float64(stats.WaitCount))
+	writeSample(w, "ntunnel_pool_wait_duration_seconds_total", "counter", "Time spent waiting for a free upstream connection.", stats.WaitDuration.Seconds())
+	writeSample(w, "ntunnel_pool_max_idle_closed_total", "counter", "Connections closed because of the idle limit.", float64(stats.MaxIdleClosed))
+	writeSample(w, "ntunnel_pool_max_idle_time_closed_total", "counter", "Connections closed because of the idle timeout.", float64(stats.MaxIdleTimeClosed))
+	writeSample(w, "ntunnel_pool_max_lifetime_closed_total", "counter", "Connections closed because of their max lifetime.", float64(stats.MaxLifetimeClosed))
+}
+
+// WriteSessionMetrics writes the number of open sessions
+func (sm *SessionManager) WriteSessionMetrics(w io.Writer) {
+	writeSample(w, "ntunnel_active_sessions", "gauge", "Open tunnel sessions.", float64(sm.Len()))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestObserveRequestActionLabel(t *testing.T) {
+	m := NewMetrics()
+	for _, action := range []string{"C", "Q", "Q", "X", "c", "Q\n", strings.Repeat("a", 100)} {
+		m.ObserveRequest(action, 0, 0)
+	}
+	var buf bytes.Buffer
+	m.requests.write(&buf)
+	for _, want := range []string{
+		`ntunnel_requests_total{action="C",status="ok"} 1`,
+		`ntunnel_requests_total{action="Q",status="ok"} 2`,
+		`ntunnel_requests_total{action="invalid",status="ok"} 4`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("metrics lack %s:\n%s", want, buf.String())
+		}
+	}
+	if n := strings.Count(buf.String(), "ntunnel_requests_total{"); n != 3 {
+		t.Errorf("got %d series, want 3:\n%s", n, buf.String())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeMySQL is a minimal MySQL server for tests. It accepts any login and
+// answers each query with the packets registered for it, or with an OK
+// packet. SELECT CONNECTION_ID() and KILL QUERY work as on a real server: a
+// killed response ends with an error packet instead of its remaining
+// packets.
+type fakeMySQL struct {
+	ln        net.Listener
+	mu        sync.Mutex
+	responses map[string][][]byte
+	killed    map[uint32]*atomic.Bool // by connection id
+	lastID    uint32
+	dropped   chan struct{} // receives when a client leaves before a response is sent
+	kills     chan struct{} // receives for each KILL QUERY
+}
+
+func newFakeMySQL(t *testing.T) *fakeMySQL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMySQL{
+		ln:        ln,
+		responses: make(map[string][][]byte),
+		killed:    make(map[uint32]*atomic.Bool),
+		dropped:   make(chan struct{}, 16),
+		kills:     make(chan struct{}, 16),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+// params returns connection parameters for the server
+func (f *fakeMySQL) params() ConnParams {
+	host, port, _ := net.SplitHostPort(f.ln.Addr().String())
+	return ConnParams{Host: host, Port: port, User: "test"}
+}
+
+// respond registers the packets sent in reply to query
+func (f *fakeMySQL) respond(query string, packets ...[]byte) {
+	f.mu.Lock()
+	f.responses[query] = packets
+	f.mu.Unlock()
+}
+
+func (f *fakeMySQL) serve(c net.Conn) {
+	defer c.Close()
+	killed := new(atomic.Bool)
+	f.mu.Lock()
+	f.lastID++
+	id := f.lastID
+	f.killed[id] = killed
+	f.mu.Unlock()
+	r := bufio.NewReader(c)
+	var seq byte
+	write := func(p []byte) error {
+		h := []byte{byte(len(p)), byte(len(p) >> 8), byte(len(p) >> 16), seq}
+		seq++
+		_, err := c.Write(append(h, p...))
+		return err
+	}
+	read := func() ([]byte, error) {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return nil, err
+		}
+		seq = h[3] + 1
+		p := make([]byte, int(h[0])|int(h[1])<<8|int(h[2])<<16)
+		_, err := io.ReadFull(r, p)
+		return p, err
+	}
+
+	// Protocol 10 handshake: PROTOCOL_41, SECURE_CONNECTION, PLUGIN_AUTH,
+	// MULTI_STATEMENTS and MULTI_RESULTS
+	caps := uint32(0x200 | 0x8000 | 0x80000 | 0x10000 | 0x20000 | 1 | 8)
+	p := append([]byte{10}, "8.0.0-fake\x00"...)
+	p = binary.LittleEndian.AppendUint32(p, id)
+	p = append(p, "abcdefgh\x00"...)
+	p = binary.LittleEndian.AppendUint16(p, uint16(caps))
+	p = append(p, 45, 2, 0)
+	p = binary.LittleEndian.AppendUint16(p, uint16(caps>>16))
+	p = append(p, 21)
+	p = append(p, make([]byte, 10)...)
+	p = append(p, "ijklmnopqrst\x00mysql_native_password\x00"...)
+	seq = 0
+	if write(p) != nil {
+		return
+	}
+	if _, err := read(); err != nil {
+		return
+	}
+	write(okPacket(0, 0, 2))
+
+	for {
+		p, err := read()
+		if err != nil || p[0] == 1 { // COM_QUIT
+			return
+		}
+		packets := [][]byte{okPacket(0, 0, 2)}
+		if p[0] == 3 { // COM_QUERY
+			packets = f.query(string(p[1:]), id)
+		}
+		killed.Store(false)
+		for i, packet := range packets {
+			if i > 0 && killed.Load() {
+				write(errPacket(1317, "70100", "Query execution was interrupted"))
+				break
+			}
+			if write(packet) != nil {
+				f.dropped <- struct{}{}
+				return
+			}
+		}
+	}
+}
+
+// query returns the response to a query sent on connection id
+func (f *fakeMySQL) query(query string, id uint32) [][]byte {
+	if query == "SELECT CONNECTION_ID()" {
+		columns := []fakeColumn{{name: "CONNECTION_ID()", typ: MYSQL_TYPE_LONGLONG, charset: BinaryCharset, length: 21}}
+		return resultSetPackets(columns, [][]*string{{strPtr(strconv.FormatUint(uint64(id), 10))}}, 2)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if target, ok := strings.CutPrefix(query, "KILL QUERY "); ok {
+		n, _ := strconv.ParseUint(target, 10, 32)
+		killed, ok := f.killed[uint32(n)]
+		if !ok {
+			return [][]byte{errPacket(1094, "HY000", "Unknown thread id: "+target)}
+		}
+		killed.Store(true)
+		f.kills <- struct{}{}
+		return [][]byte{okPacket(0, 0, 2)}
+	}
+	if resp, ok := f.responses[query]; ok {
+		return resp
+	}
+	return [][]byte{okPacket(0, 0, 2)}
+}
+
+// lenEncString encodes a length-encoded string
+func lenEncString(s string) []byte {
+	return append(lenEncInt(uint64(len(s))), s...)
+}
+
+func lenEncInt(n uint64) []byte {
+	switch {
+	case n < 251:
+		return []byte{byte(n)}
+	case n < 1<<16:
+		return []byte{0xfc, byte(n), byte(n >> 8)}
+	}
+	return append([]byte{0xfe}, binary.LittleEndian.AppendUint64(nil, n)...)
+}
+
+// okPacket builds an OK packet. A status with 0x08 announces more results.
+func okPacket(affected, insertID uint64, status uint16) []byte {
+	p := append([]byte{0}, lenEncInt(affected)...)
+	p = append(p, lenEncInt(insertID)...)
+	return append(p, byte(status), byte(status>>8), 0, 0)
+}
+
+func eofPacket(status uint16) []byte {
+	return []byte{0xfe, 0, 0, byte(status), byte(status >> 8)}
+}
+
+func errPacket(code uint16, state, message string) []byte {
+	p := []byte{0xff, byte(code), byte(code >> 8), '#'}
+	return append(append(p, state...), message...)
+}
+
+// fakeColumn is a column definition sent by fakeMySQL
+type fakeColumn struct {
+	name, table string
+	typ         MySQLFieldType
+	flags       MySQLFieldFlag
+	charset     uint16
+	length      uint32
+	decimals    byte
+}
+
+// resultSetPackets builds a text protocol result set. A nil value is NULL.
+func resultSetPackets(columns []fakeColumn, rows [][]*string, status uint16) [][]byte {
+	packets := [][]byte{lenEncInt(uint64(len(columns)))}
+	for _, c := range columns {
+		p := lenEncString("def")
+		for _, s := range []string{"db", c.table, c.table, c.name, c.name} {
+			p = append(p, lenEncString(s)...)
+		}
+		p = append(p, 0x0c)
+		p = binary.LittleEndian.AppendUint16(p, c.charset)
+		p = binary.LittleEndian.AppendUint32(p, c.length)
+		p = append(p, byte(c.typ))
+		p = binary.LittleEndian.AppendUint16(p, uint16(c.flags))
+		p = append(p, c.decimals, 0, 0)
+		packets = append(packets, p)
+	}
+	packets = append(packets, eofPacket(2))
+	for _, row := range rows {
+		var p []byte
+		for _, v := range row {
+			if v == nil {
+				p = append(p, 0xfb)
+			} else {
+				p = append(p, lenEncString(*v)...)
+			}
+		}
+		packets = append(packets, p)
+	}
+	return append(packets, eofPacket(status))
+}
+
+func strPtr(s string) *string { return &s }
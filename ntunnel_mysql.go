@@ -2,37 +2,88 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-)
-
-// Configuration
-const (
-	AllowTestMenu = true
-	DefaultPort   = ":8000"
+	"github.com/go-sql-driver/mysql"
 )
 
 // NavicatTunnel handles the HTTP tunnel functionality
-type NavicatTunnel struct{}
+type NavicatTunnel struct {
+	pools    *PoolManager
+	sessions *SessionManager
+	auth     *Authenticator
+
+	// TestMenu serves the test page to browsers and incomplete requests
+	TestMenu bool
+	// MultiStatements lets a single query contain several statements
+	MultiStatements bool
+	// TimeZone is the session time zone of upstream connections, if set
+	TimeZone string
+	// Charset is the connection character set used when a request names none
+	Charset string
+	// Collation is the connection collation used along with Charset
+	Collation string
+	// TLS is the upstream TLS config used when neither profile nor request
+	// names one
+	TLS string
+	// TLSConfigs are the registered upstream TLS configs a request may name
+	TLSConfigs map[string]bool
+	// QueryTimeout limits the execution time of each query, if set
+	QueryTimeout time.Duration
+	// KillOnCancel aborts statements on the server when their request is
+	// cancelled or times out
+	KillOnCancel bool
+	// Audit records requests and queries, if set
+	Audit *AuditLog
+	// Metrics counts requests and queries, if set
+	Metrics *Metrics
+	// WriteTimeout limits each write of a response, if set
+	WriteTimeout time.Duration
+	// MaxBodySize limits the size of request bodies; no limit if 0
+	MaxBodySize int64
+	// MaxQueries limits the number of queries per request, if set
+	MaxQueries int
+	// Limits caps request rates and concurrency per client, user and target
+	Limits Limits
+	// Profiles are the server-side connection profiles by name
+	Profiles map[string]*Profile
+	// RequireProfile rejects requests which name their own server and login
+	RequireProfile bool
+	// Policy limits the statements of tunnel users without their own policy
+	Policy *StatementPolicy
+	// UserPolicies are the statement policies by tunnel user
+	UserPolicies map[string]*StatementPolicy
+	// ResultLimit caps the size of each result set sent to clients
+	ResultLimit ResultLimit
+	// SpoolMaxSize bounds the disk space spooling a result set may take, if
+	// set. Result sets beyond it fail.
+	SpoolMaxSize int64
+}
 
 // NewNavicatTunnel creates a new tunnel instance
-func NewNavicatTunnel() *NavicatTunnel {
-	return &NavicatTunnel{}
+func NewNavicatTunnel(pools *PoolManager, sessions *SessionManager, auth *Authenticator) *NavicatTunnel {
+	return &NavicatTunnel{pools: pools, sessions: sessions, auth: auth}
 }
 
 // GetLongBinary converts uint32 to 4-byte big-endian
@@ -56,7 +107,12 @@ func (nt *NavicatTunnel) GetDummy(count int) []byte {
 
 // GetBlock encodes string with length prefix
 func (nt *NavicatTunnel) GetBlock(val string) []byte {
-	data := []byte(val)
+	return nt.GetBlockBytes([]byte(val))
+}
+
+// GetBlockBytes encodes raw bytes with length prefix. The bytes are copied
+// as they are, so binary data and text in any character set pass unchanged.
+func (nt *NavicatTunnel) GetBlockBytes(data []byte) []byte {
 	length := len(data)
 	
 	if length < 254 {
@@ -84,12 +140,12 @@ func (nt *NavicatTunnel) EchoHeader(errno uint32) []byte {
 }
 
 // EchoConnInfo generates connection information
-func (nt *NavicatTunnel) EchoConnInfo(db *sql.DB) []byte {
+func (nt *NavicatTunnel) EchoConnInfo(ctx context.Context, db *sql.DB) []byte {
 	var buf bytes.Buffer
 	
 	// Get server version
 	var version string
-	err := db.QueryRow("SELECT VERSION()").Scan(&version)
+	err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version)
 	if err != nil {
 		version = "Unknown"
 	}
@@ -138,6 +194,7 @@ const (
 	MYSQL_TYPE_NEWDATE
 	MYSQL_TYPE_VARCHAR     = 15
 	MYSQL_TYPE_BIT         = 16
+	MYSQL_TYPE_VECTOR      = 242
 	MYSQL_TYPE_JSON        = 245
 	MYSQL_TYPE_NEWDECIMAL  = 246
 	MYSQL_TYPE_ENUM        = 247
@@ -176,113 +233,196 @@ func (nt *NavicatTunnel) MapGoTypeToMySQL(goType reflect.Type) MySQLFieldType {
 }
 
 // EchoFieldsHeader generates fields header information
-func (nt *NavicatTunnel) EchoFieldsHeader(columns []string, types []*sql.ColumnType) []byte {
+func (nt *NavicatTunnel) EchoFieldsHeader(fields []ColumnMeta) []byte {
 	var buf bytes.Buffer
 	
-	for i, column := range columns {
-		// Field name
-		buf.Write(nt.GetBlock(column))
-		// Table name (not available in Go's sql package)
-		buf.Write(nt.GetBlock(""))
-		
-		// Field type - try to determine from column type
-		var fieldType MySQLFieldType = MYSQL_TYPE_VAR_STRING
-		var length uint32 = 255
-		var flags uint32 = 0
-		
-		if i < len(types) && types[i] != nil {
-			// Try to get length information
-			if l, ok := types[i].Length(); ok {
-				length = uint32(l)
-			}
-			
-			// Try to determine type from database type name
-			dbType := strings.ToUpper(types[i].DatabaseTypeName())
-			fieldType = nt.GetMySQLTypeFromName(dbType)
-			
-			// Check nullable
-			if nullable, ok := types[i].Nullable(); ok && !nullable {
-				flags |= 1 // NOT_NULL flag
+	for _, field := range fields {
+		buf.Write(nt.GetBlock(field.Name))
+		buf.Write(nt.GetBlock(field.Table))
+		buf.Write(nt.GetLongBinary(uint32(field.Type)))
+		buf.Write(nt.GetLongBinary(uint32(field.Flags)))
+		buf.Write(nt.GetLongBinary(field.Length))
+	}
+	
+	return buf.Bytes()
+}
+
+// ResultFields returns the column definitions of the current result set,
+// falling back to what database/sql exposes if the driver's are unavailable
+func (nt *NavicatTunnel) ResultFields(rows *sql.Rows, columns []string) []ColumnMeta {
+	fields, ok := DriverColumnMeta(rows)
+	if !ok || len(fields) != len(columns) {
+		types, _ := rows.ColumnTypes()
+		fields = make([]ColumnMeta, len(columns))
+		for i, column := range columns {
+			var ct *sql.ColumnType
+			if i < len(types) {
+				ct = types[i]
 			}
+			fields[i] = nt.FieldFromColumnType(column, ct)
 		}
-		
-		buf.Write(nt.GetLongBinary(uint32(fieldType)))
-		buf.Write(nt.GetLongBinary(flags))
-		buf.Write(nt.GetLongBinary(length))
 	}
 	
-	return buf.Bytes()
+	for i := range fields {
+		fields[i].Flags = FieldFlags(fields[i])
+	}
+	return fields
 }
 
-// GetMySQLTypeFromName maps database type name to MySQL type
-func (nt *NavicatTunnel) GetMySQLTypeFromName(typeName string) MySQLFieldType {
-	switch {
-	case strings.Contains(typeName, "TINYINT"):
-		return MYSQL_TYPE_TINY
-	case strings.Contains(typeName, "SMALLINT"):
-		return MYSQL_TYPE_SHORT
-	case strings.Contains(typeName, "MEDIUMINT"):
-		return MYSQL_TYPE_INT24
-	case strings.Contains(typeName, "BIGINT"):
-		return MYSQL_TYPE_LONGLONG
-	case strings.Contains(typeName, "INT"):
-		return MYSQL_TYPE_LONG
-	case strings.Contains(typeName, "FLOAT"):
-		return MYSQL_TYPE_FLOAT
-	case strings.Contains(typeName, "DOUBLE"):
-		return MYSQL_TYPE_DOUBLE
-	case strings.Contains(typeName, "DECIMAL"):
-		return MYSQL_TYPE_NEWDECIMAL
-	case strings.Contains(typeName, "DATE"):
-		return MYSQL_TYPE_DATE
-	case strings.Contains(typeName, "TIME"):
-		if strings.Contains(typeName, "DATETIME") || strings.Contains(typeName, "TIMESTAMP") {
-			return MYSQL_TYPE_DATETIME
-		}
-		return MYSQL_TYPE_TIME
-	case strings.Contains(typeName, "YEAR"):
-		return MYSQL_TYPE_YEAR
-	case strings.Contains(typeName, "CHAR"), strings.Contains(typeName, "VARCHAR"):
-		return MYSQL_TYPE_VAR_STRING
-	case strings.Contains(typeName, "TEXT"):
-		return MYSQL_TYPE_BLOB
-	case strings.Contains(typeName, "BLOB"):
-		return MYSQL_TYPE_BLOB
-	case strings.Contains(typeName, "JSON"):
-		return MYSQL_TYPE_JSON
-	default:
-		return MYSQL_TYPE_VAR_STRING
+// FieldFromColumnType rebuilds a column definition from database/sql's
+// column type
+func (nt *NavicatTunnel) FieldFromColumnType(column string, ct *sql.ColumnType) ColumnMeta {
+	// Field type - try to determine from column type
+	field := ColumnMeta{Name: column, Type: MYSQL_TYPE_VAR_STRING, Length: 255}
+	if ct == nil {
+		return field
 	}
+	
+	// Try to get length information
+	if l, ok := ct.Length(); ok {
+		field.Length = uint32(l)
+	}
+	
+	// Try to determine type from database type name
+	dbType := strings.ToUpper(ct.DatabaseTypeName())
+	field.Type = nt.GetMySQLTypeFromName(dbType)
+	
+	if strings.Contains(dbType, "UNSIGNED") {
+		field.Flags |= UNSIGNED_FLAG
+	}
+	if strings.Contains(dbType, "BINARY") || strings.Contains(dbType, "BLOB") || dbType == "BIT" {
+		field.Charset = BinaryCharset
+	}
+	
+	// Check nullable
+	if nullable, ok := ct.Nullable(); ok && !nullable {
+		field.Flags |= NOT_NULL_FLAG
+	}
+	return field
 }
 
-// EchoData generates result data
-func (nt *NavicatTunnel) EchoData(rows *sql.Rows, numFields int) []byte {
-	var buf bytes.Buffer
+// mysqlTypeNames maps type names, as reported by the driver or written in
+// column definitions, to MySQL field types
+var mysqlTypeNames = map[string]MySQLFieldType{
+	// Integers and their aliases
+	"TINYINT": MYSQL_TYPE_TINY, "INT1": MYSQL_TYPE_TINY, "BOOL": MYSQL_TYPE_TINY, "BOOLEAN": MYSQL_TYPE_TINY,
+	"SMALLINT": MYSQL_TYPE_SHORT, "INT2": MYSQL_TYPE_SHORT,
+	"MEDIUMINT": MYSQL_TYPE_INT24, "MIDDLEINT": MYSQL_TYPE_INT24, "INT3": MYSQL_TYPE_INT24,
+	"INT": MYSQL_TYPE_LONG, "INTEGER": MYSQL_TYPE_LONG, "INT4": MYSQL_TYPE_LONG,
+	"BIGINT": MYSQL_TYPE_LONGLONG, "INT8": MYSQL_TYPE_LONGLONG, "SERIAL": MYSQL_TYPE_LONGLONG,
+
+	// Fixed and floating point
+	"DECIMAL": MYSQL_TYPE_NEWDECIMAL, "DEC": MYSQL_TYPE_NEWDECIMAL, "NUMERIC": MYSQL_TYPE_NEWDECIMAL, "FIXED": MYSQL_TYPE_NEWDECIMAL,
+	"FLOAT": MYSQL_TYPE_FLOAT, "FLOAT4": MYSQL_TYPE_FLOAT,
+	"DOUBLE": MYSQL_TYPE_DOUBLE, "DOUBLE PRECISION": MYSQL_TYPE_DOUBLE, "REAL": MYSQL_TYPE_DOUBLE, "FLOAT8": MYSQL_TYPE_DOUBLE,
+	"BIT": MYSQL_TYPE_BIT,
+
+	// Temporal
+	"DATE": MYSQL_TYPE_DATE, "NEWDATE": MYSQL_TYPE_NEWDATE,
+	"TIME": MYSQL_TYPE_TIME,
+	"DATETIME": MYSQL_TYPE_DATETIME,
+	"TIMESTAMP": MYSQL_TYPE_TIMESTAMP,
+	"YEAR": MYSQL_TYPE_YEAR,
+
+	// Strings
+	"CHAR": MYSQL_TYPE_STRING, "CHARACTER": MYSQL_TYPE_STRING, "NCHAR": MYSQL_TYPE_STRING, "BINARY": MYSQL_TYPE_STRING,
+	"VARCHAR": MYSQL_TYPE_VAR_STRING, "CHARACTER VARYING": MYSQL_TYPE_VAR_STRING, "NVARCHAR": MYSQL_TYPE_VAR_STRING,
+	"VARBINARY": MYSQL_TYPE_VAR_STRING,
+	"ENUM": MYSQL_TYPE_ENUM,
+	"SET":  MYSQL_TYPE_SET,
+
+	// BLOB and TEXT by size class
+	"TINYBLOB": MYSQL_TYPE_TINY_BLOB, "TINYTEXT": MYSQL_TYPE_TINY_BLOB,
+	"BLOB": MYSQL_TYPE_BLOB, "TEXT": MYSQL_TYPE_BLOB,
+	"MEDIUMBLOB": MYSQL_TYPE_MEDIUM_BLOB, "MEDIUMTEXT": MYSQL_TYPE_MEDIUM_BLOB, "LONG": MYSQL_TYPE_MEDIUM_BLOB, "LONG VARCHAR": MYSQL_TYPE_MEDIUM_BLOB,
+	"LONGBLOB": MYSQL_TYPE_LONG_BLOB, "LONGTEXT": MYSQL_TYPE_LONG_BLOB,
+	"JSON": MYSQL_TYPE_JSON,
+
+	// Spatial
+	"GEOMETRY": MYSQL_TYPE_GEOMETRY, "POINT": MYSQL_TYPE_GEOMETRY, "LINESTRING": MYSQL_TYPE_GEOMETRY,
+	"POLYGON": MYSQL_TYPE_GEOMETRY, "MULTIPOINT": MYSQL_TYPE_GEOMETRY, "MULTILINESTRING": MYSQL_TYPE_GEOMETRY,
+	"MULTIPOLYGON": MYSQL_TYPE_GEOMETRY, "GEOMETRYCOLLECTION": MYSQL_TYPE_GEOMETRY, "GEOMCOLLECTION": MYSQL_TYPE_GEOMETRY,
+
+	"VECTOR": MYSQL_TYPE_VECTOR,
+	"NULL":   MYSQL_TYPE_NULL,
+}
+
+// GetMySQLTypeFromName maps database type name to MySQL type. Names may
+// carry a length and attributes as in "INT(10) UNSIGNED ZEROFILL" or the
+// driver's "UNSIGNED INT"; unknown names map to VAR_STRING.
+func (nt *NavicatTunnel) GetMySQLTypeFromName(typeName string) MySQLFieldType {
+	name := strings.ToUpper(strings.TrimSpace(typeName))
+	if i := strings.IndexByte(name, '('); i >= 0 {
+		if j := strings.IndexByte(name[i:], ')'); j >= 0 {
+			name = name[:i] + name[i+j+1:]
+		} else {
+			name = name[:i]
+		}
+	}
 	
+	words := strings.Fields(name)
+	kept := words[:0]
+	for i, word := range words {
+		// Attributes up to the character set or collation don't matter
+		if word == "CHARSET" || word == "COLLATE" ||
+			(word == "CHARACTER" && i > 0 && i+1 < len(words) && words[i+1] == "SET") {
+			break
+		}
+		switch word {
+		case "UNSIGNED", "SIGNED", "ZEROFILL", "NATIONAL":
+			continue
+		}
+		kept = append(kept, word)
+	}
+	
+	if fieldType, ok := mysqlTypeNames[strings.Join(kept, " ")]; ok {
+		return fieldType
+	}
+	return MYSQL_TYPE_VAR_STRING
+}
+
+// EchoData writes result data for every remaining row and returns the row
+// count. Once a row would exceed the ResultLimit, it stops reading and
+// returns *ResultTruncated along with the rows written so far.
+func (nt *NavicatTunnel) EchoData(w io.Writer, rows *sql.Rows, fields []ColumnMeta) (uint32, error) {
+	var numRows uint32
+	var size int64
+	numFields := len(fields)
+	limit := nt.ResultLimit
+
 	// Create slice to hold column values
 	columns := make([]interface{}, numFields)
 	columnPointers := make([]interface{}, numFields)
-	
+
 	for i := range columns {
 		columnPointers[i] = &columns[i]
 	}
-	
+
+	// Each row is encoded first, so the byte limit is checked before any of
+	// it is written
+	var row bytes.Buffer
 	for rows.Next() {
+		if limit.MaxRows > 0 && int(numRows) >= limit.MaxRows {
+			return numRows, &ResultTruncated{Rows: numRows, Limit: fmt.Sprintf("limit of %d rows", limit.MaxRows)}
+		}
 		err := rows.Scan(columnPointers...)
 		if err != nil {
 			continue
 		}
-		
+
+		row.Reset()
 		for _, col := range columns {
 			if col == nil {
-				buf.Write([]byte{0xFF})
+				row.WriteByte(0xFF)
+			} else if v, ok := col.([]byte); ok {
+				// Text protocol values, in the connection character set or
+				// binary, are sent without any conversion
+				row.Write(nt.GetBlockBytes(v))
 			} else {
 				var value string
 				switch v := col.(type) {
 				case string:
 					value = v
-				case []byte:
-					value = string(v)
 				case int64:
 					value = strconv.FormatInt(v, 10)
 				case float64:
@@ -293,76 +433,143 @@ func (nt *NavicatTunnel) EchoData(rows *sql.Rows, numFields int) []byte {
 					} else {
 						value = "0"
 					}
-				case time.Time:
-					value = v.Format("2006-01-02 15:04:05")
 				default:
 					value = fmt.Sprintf("%v", v)
 				}
-				buf.Write(nt.GetBlock(value))
+				row.Write(nt.GetBlock(value))
 			}
 		}
+		if limit.MaxBytes > 0 && size+int64(row.Len()) > limit.MaxBytes {
+			return numRows, &ResultTruncated{Rows: numRows, Limit: fmt.Sprintf("limit of %d bytes", limit.MaxBytes)}
+		}
+		if _, err := w.Write(row.Bytes()); err != nil {
+			return numRows, err
+		}
+		size += int64(row.Len())
+		numRows++
 	}
-	
-	return buf.Bytes()
+
+	return numRows, rows.Err()
 }
 
-// HandleConnectionTest handles connection testing
-func (nt *NavicatTunnel) HandleConnectionTest(params url.Values) []byte {
-	host := params.Get("host")
-	if host == "" {
-		host = "localhost"
+// requestProfile returns the profile a request selects, either by the
+// profile form field or by a host name equal to a profile name
+func (nt *NavicatTunnel) requestProfile(params url.Values) (*Profile, bool) {
+	if name := params.Get("profile"); name != "" {
+		p, ok := nt.Profiles[name]
+		return p, ok
 	}
-	
-	port := params.Get("port")
-	if port == "" {
-		port = "3306"
+	p, ok := nt.Profiles[params.Get("host")]
+	return p, ok
+}
+
+// requestPolicy combines the statement policy of the tunnel user with the
+// one of the profile the request selects
+func (nt *NavicatTunnel) requestPolicy(r *http.Request) Policy {
+	var pol Policy
+	if sp, ok := nt.UserPolicies[TunnelUser(r.Context())]; ok {
+		pol = append(pol, sp)
+	} else if nt.Policy != nil {
+		pol = append(pol, nt.Policy)
 	}
-	
-	user := params.Get("login")
-	password := params.Get("password")
-	database := params.Get("db")
-	
-	// Build DSN
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true",
-		user, password, host, port, database)
-	
-	// Test connection
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nt.createErrorResponse(2000, err.Error())
+	if profile, ok := nt.requestProfile(r.Form); ok && profile.Policy != nil {
+		pol = append(pol, profile.Policy)
+	}
+	return pol
+}
+
+// connParams returns the upstream connection parameters of a request. A
+// request which selects a profile may still choose the database and
+// character set, and a registered TLS config if the profile sets none.
+func (nt *NavicatTunnel) connParams(r *http.Request) (ConnParams, error) {
+	var p ConnParams
+	if profile, ok := nt.requestProfile(r.Form); ok {
+		if !profile.Permits(TunnelUser(r.Context())) {
+			return p, fmt.Errorf("profile %q is not permitted", profile.Name)
+		}
+		p = profile.ConnParams()
+		if db := r.Form.Get("db"); db != "" {
+			p.Database = db
+		}
+		// A collation belongs to its charset, so a new charset drops the
+		// profile's collation
+		if charset := r.Form.Get("charset"); charset != "" {
+			p.Charset, p.Collation = charset, ""
+		}
+		if collation := r.Form.Get("collation"); collation != "" {
+			p.Collation = collation
+		}
+	} else if name := r.Form.Get("profile"); name != "" {
+		return p, fmt.Errorf("unknown profile %q", name)
+	} else if nt.RequireProfile {
+		return p, fmt.Errorf("a connection profile is required")
+	} else {
+		p = ConnParamsFromForm(r.Form)
 	}
-	defer db.Close()
 	
-	// Test actual connection
-	err = db.Ping()
+	// Requests can't pick the driver's built-in configs, which would let them
+	// turn off or weaken TLS the operator set up
+	if name := r.Form.Get("tls"); name != "" && p.TLS == "" {
+		if !nt.TLSConfigs[name] {
+			return p, fmt.Errorf("unknown TLS config %q", name)
+		}
+		p.TLS = name
+	}
+	nt.applyDefaults(&p)
+	p.ReadOnly = nt.requestPolicy(r).ReadOnly()
+	return p, nil
+}
+
+// applyDefaults sets the tunnel's session settings and fills in the charset
+// and TLS config where p names none
+func (nt *NavicatTunnel) applyDefaults(p *ConnParams) {
+	p.MultiStatements = nt.MultiStatements
+	p.TimeZone = nt.TimeZone
+	if p.Charset == "" && p.Collation == "" {
+		p.Charset, p.Collation = nt.Charset, nt.Collation
+	}
+	if p.TLS == "" {
+		p.TLS = nt.TLS
+	}
+}
+
+// ProfileParams returns the connection parameters of a request which selects
+// profile and sets nothing else, so they share the request's pool key. The
+// tunnel user's policy is left out, as there is none.
+func (nt *NavicatTunnel) ProfileParams(profile *Profile) ConnParams {
+	p := profile.ConnParams()
+	nt.applyDefaults(&p)
+	var pol Policy
+	if nt.Policy != nil {
+		pol = append(pol, nt.Policy)
+	}
+	if profile.Policy != nil {
+		pol = append(pol, profile.Policy)
+	}
+	p.ReadOnly = pol.ReadOnly()
+	return p
+}
+
+// HandleConnectionTest handles connection testing. A connection error is
+// returned as well as written into the response.
+func (nt *NavicatTunnel) HandleConnectionTest(ctx context.Context, p ConnParams) ([]byte, error) {
+	// Test connection
+	db, release, err := nt.pools.Acquire(ctx, p)
 	if err != nil {
-		return nt.createErrorResponse(2000, err.Error())
+		return nt.createErrorResponse(2000, err.Error()), err
 	}
+	defer release()
 	
 	// Success - return connection info
 	var buf bytes.Buffer
 	buf.Write(nt.EchoHeader(0))
-	buf.Write(nt.EchoConnInfo(db))
+	buf.Write(nt.EchoConnInfo(ctx, db))
 	
-	return buf.Bytes()
+	return buf.Bytes(), nil
 }
 
-// HandleQueryExecution handles query execution
-func (nt *NavicatTunnel) HandleQueryExecution(params url.Values) []byte {
-	host := params.Get("host")
-	if host == "" {
-		host = "localhost"
-	}
-	
-	port := params.Get("port")
-	if port == "" {
-		port = "3306"
-	}
-	
-	user := params.Get("login")
-	password := params.Get("password")
-	database := params.Get("db")
-	
+// RequestQueries returns the queries of a request, decoding them if needed
+func (nt *NavicatTunnel) RequestQueries(params url.Values) []string {
 	// Handle base64 encoding
 	queries := params["q"]
 	if params.Get("encodeBase64") == "1" {
@@ -372,26 +579,20 @@ func (nt *NavicatTunnel) HandleQueryExecution(params url.Values) []byte {
 			}
 		}
 	}
-	
-	// Build DSN
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true",
-		user, password, host, port, database)
-	
-	// Open connection
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nt.createErrorResponse(2000, err.Error())
-	}
-	defer db.Close()
-	
-	// Test connection
-	err = db.Ping()
-	if err != nil {
-		return nt.createErrorResponse(2000, err.Error())
+	return queries
+}
+
+// HandleQueryExecution runs queries on conn, streaming the response to w,
+// and returns the stats of the queries it ran. Queries the policy denies get
+// an error block instead of running. Each query runs for at most
+// QueryTimeout, and qc, if set, kills it on the server once ctx is done or
+// its result set is cut short.
+func (nt *NavicatTunnel) HandleQueryExecution(ctx context.Context, w io.Writer, conn *sql.Conn, queries []string, policy Policy, qc *QueryCanceler) ([]QueryStats, error) {
+	if _, err := w.Write(nt.EchoHeader(0)); err != nil {
+		return nil, err
 	}
-	
-	var buf bytes.Buffer
-	buf.Write(nt.EchoHeader(0))
+	stats := make([]QueryStats, 0, len(queries))
+	aborted := false
 	
 	// Execute queries
 	for i, query := range queries {
@@ -400,135 +601,267 @@ func (nt *NavicatTunnel) HandleQueryExecution(params url.Values) []byte {
 			continue
 		}
 		
-		// Execute query
-		var errno uint32 = 0
-		var affectedRows, insertID, numFields, numRows uint32 = 0, 0, 0, 0
-		var errorMsg string
-		
-		// Determine if it's a SELECT query
-		isSelect := strings.HasPrefix(strings.ToUpper(query), "SELECT")
+		// Statements that may return rows run as queries, as do multiple
+		// statements sent at once. Each gets a context of its own, so it
+		// can be aborted on its own.
+		var queryCtx context.Context
+		var cancel context.CancelFunc
+		if nt.QueryTimeout > 0 {
+			queryCtx, cancel = context.WithTimeout(ctx, nt.QueryTimeout)
+		} else {
+			queryCtx, cancel = context.WithCancel(ctx)
+		}
+		stop := qc.Watch(queryCtx)
+		st := QueryStats{Query: query, Start: time.Now()}
+		var err error
+		if aborted {
+			err = nt.echoQueryError(w, errAbortedConn, &st)
+		} else if denied := policy.Check(query); denied != nil {
+			err = nt.echoQueryError(w, denied, &st)
+		} else if ClassifyStatement(query) == StatementNoRows && len(SplitStatements(query)) == 1 {
+			err = nt.echoExecResult(queryCtx, w, conn, query, &st)
+		} else {
+			err = nt.echoQueryResult(queryCtx, w, conn, qc, query, &st)
+		}
+		stop()
+		cancel()
+		st.Duration = time.Since(st.Start)
+		stats = append(stats, st)
+		if err != nil {
+			return stats, err
+		}
+		// A statement which could not be killed was stopped by closing
+		// its connection
+		aborted = aborted || st.aborted
 		
-		if isSelect {
-			// Handle SELECT query
-			rows, err := db.Query(query)
-			if err != nil {
-				errno = 1000
-				errorMsg = err.Error()
-			} else {
-				defer rows.Close()
-				
-				// Get column information
-				columns, err := rows.Columns()
-				if err != nil {
-					errno = 1000
-					errorMsg = err.Error()
-				} else {
-					numFields = uint32(len(columns))
-					
-					// Count rows by scanning through them
-					rowCount := uint32(0)
-					var rowsData bytes.Buffer
-					
-					// Get column types
-					columnTypes, _ := rows.ColumnTypes()
-					
-					// Store field header
-					fieldsHeader := nt.EchoFieldsHeader(columns, columnTypes)
-					
-					// Count and store data
-					columnValues := make([]interface{}, len(columns))
-					columnPointers := make([]interface{}, len(columns))
-					for i := range columnValues {
-						columnPointers[i] = &columnValues[i]
-					}
-					
-					for rows.Next() {
-						rowCount++
-						err := rows.Scan(columnPointers...)
-						if err != nil {
-							continue
-						}
-						
-						for _, col := range columnValues {
-							if col == nil {
-								rowsData.Write([]byte{0xFF})
-							} else {
-								var value string
-								switch v := col.(type) {
-								case string:
-									value = v
-								case []byte:
-									value = string(v)
-								case int64:
-									value = strconv.FormatInt(v, 10)
-								case float64:
-									value = strconv.FormatFloat(v, 'f', -1, 64)
-								case bool:
-									if v {
-										value = "1"
-									} else {
-										value = "0"
-									}
-								case time.Time:
-									value = v.Format("2006-01-02 15:04:05")
-								default:
-									value = fmt.Sprintf("%v", v)
-								}
-								rowsData.Write(nt.GetBlock(value))
-							}
-						}
-					}
-					
-					numRows = rowCount
-					
-					// Write result set header
-					buf.Write(nt.EchoResultSetHeader(errno, affectedRows, insertID, numFields, numRows))
-					
-					if errno == 0 {
-						// Write fields header and data
-						buf.Write(fieldsHeader)
-						buf.Write(rowsData.Bytes())
-					} else {
-						buf.Write(nt.GetBlock(errorMsg))
-					}
+		// Add query separator
+		if i < len(queries)-1 {
+			_, err = w.Write([]byte{0x01})
+		} else {
+			_, err = w.Write([]byte{0x00})
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+	
+	return stats, nil
+}
+
+// echoQueryResult runs a query and writes each result set it returns, or
+// its status if it returns no columns at all. Result sets after the first
+// one, as returned by stored procedures and multi-statement queries, are
+// separated by 0x01 like the results of separate queries. Once a result set
+// is cut short, the statement is stopped through qc and later result sets
+// are lost. The returned error is only set when writing to w fails.
+func (nt *NavicatTunnel) echoQueryResult(ctx context.Context, w io.Writer, conn *sql.Conn, qc *QueryCanceler, query string, st *QueryStats) error {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nt.echoQueryError(w, err, st)
+	}
+	defer rows.Close()
+
+	resultSets := 0
+	for {
+		// Get column information
+		columns, err := rows.Columns()
+		if err != nil {
+			break
+		}
+		if len(columns) > 0 {
+			if resultSets > 0 {
+				if _, err := w.Write([]byte{0x01}); err != nil {
+					return err
 				}
 			}
-		} else {
-			// Handle non-SELECT query
-			result, err := db.Exec(query)
-			if err != nil {
-				errno = 1000
-				errorMsg = err.Error()
-			} else {
-				if affected, err := result.RowsAffected(); err == nil {
-					affectedRows = uint32(affected)
+			resultSets++
+			truncated, ok, err := nt.echoResultSet(w, rows, columns, st, func(reason error) {
+				st.aborted = !abortQuery(conn, qc, reason)
+			})
+			if !ok {
+				return err
+			}
+			if truncated != nil {
+				if _, err := w.Write([]byte{0x01}); err != nil {
+					return err
 				}
-				if lastID, err := result.LastInsertId(); err == nil {
-					insertID = uint32(lastID)
+				if nt.ResultLimit.Fail {
+					return nt.echoQueryError(w, abortedError(truncated, st), st)
 				}
-			}
-			
-			// Write result set header
-			buf.Write(nt.EchoResultSetHeader(errno, affectedRows, insertID, numFields, numRows))
-			
-			if errno > 0 {
-				buf.Write(nt.GetBlock(errorMsg))
-			} else {
-				// Add info block
-				info := fmt.Sprintf("Rows affected: %d", affectedRows)
-				buf.Write(nt.GetBlock(info))
+				return nt.echoNotice(w, abortedError(truncated, st).Error())
 			}
 		}
-		
-		// Add query separator
-		if i < len(queries)-1 {
-			buf.Write([]byte{0x01})
-		} else {
-			buf.Write([]byte{0x00})
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		if resultSets > 0 {
+			if _, err := w.Write([]byte{0x01}); err != nil {
+				return err
+			}
 		}
+		return nt.echoQueryError(w, err, st)
+	}
+	if resultSets == 0 {
+		// Only OK packets were received, the last of which holds the counts
+		rows.Close()
+		affected, insertID, _ := DriverResultCounts(conn)
+		st.Affected = affected
+		return nt.echoStatusResult(w, uint32(affected), uint32(insertID))
+	}
+	return nil
+}
+
+// echoResultSet writes the current result set of rows. Rows are spooled
+// while they are counted, so only the spool's memory limit is held in memory
+// regardless of the result size. It reports false if the result set failed,
+// in which case the error block has been written unless err is set, and
+// returns truncated if the rows were cut short by the ResultLimit. Either way
+// the statement is stopped through abort if rows are left unread, since
+// reading them could take as long as sending them would.
+func (nt *NavicatTunnel) echoResultSet(w io.Writer, rows *sql.Rows, columns []string, st *QueryStats, abort func(reason error)) (truncated *ResultTruncated, ok bool, err error) {
+	fields := nt.ResultFields(rows, columns)
+
+	spool := NewRowSpool(SpoolMemoryLimit, nt.SpoolMaxSize)
+	defer spool.Close()
+
+	numRows, err := nt.EchoData(spool, rows, fields)
+	var full *SpoolFullError
+	if errors.As(err, &truncated) {
+		st.Truncated = true
+		abort(truncated)
+		err = nil
+	} else if errors.As(err, &full) {
+		abort(full)
+		err = abortedError(full, st)
+	}
+	if err != nil {
+		return nil, false, nt.echoQueryError(w, err, st)
+	}
+	st.Rows += uint64(numRows)
+
+	if _, err := w.Write(nt.EchoResultSetHeader(0, 0, 0, uint32(len(columns)), numRows)); err != nil {
+		return nil, false, err
+	}
+	if _, err := w.Write(nt.EchoFieldsHeader(fields)); err != nil {
+		return nil, false, err
+	}
+	_, err = spool.WriteTo(w)
+	return truncated, err == nil, err
+}
+
+// abortedError adds to the error which stopped a statement that its
+// connection was closed to do so, if it was
+func abortedError(err error, st *QueryStats) error {
+	if !st.aborted {
+		return err
+	}
+	return fmt.Errorf("%w; the statement could not be killed, so its connection was closed and later queries are not run", err)
+}
+
+// echoExecResult runs a statement without a result set and writes its status
+func (nt *NavicatTunnel) echoExecResult(ctx context.Context, w io.Writer, conn *sql.Conn, query string, st *QueryStats) error {
+	var affectedRows, insertID uint32
+
+	result, err := conn.ExecContext(ctx, query)
+	if err != nil {
+		return nt.echoQueryError(w, err, st)
 	}
+	if affected, err := result.RowsAffected(); err == nil {
+		affectedRows = uint32(affected)
+		st.Affected = uint64(affected)
+	}
+	if lastID, err := result.LastInsertId(); err == nil {
+		insertID = uint32(lastID)
+	}
+
+	return nt.echoStatusResult(w, affectedRows, insertID)
+}
+
+// echoStatusResult writes the result of a statement without a result set
+func (nt *NavicatTunnel) echoStatusResult(w io.Writer, affectedRows, insertID uint32) error {
+	if _, err := w.Write(nt.EchoResultSetHeader(0, affectedRows, insertID, 0, 0)); err != nil {
+		return err
+	}
+
+	// Add info block
+	info := fmt.Sprintf("Rows affected: %d", affectedRows)
+	_, err := w.Write(nt.GetBlock(info))
+	return err
+}
+
+// echoNotice writes a result without rows whose info block carries message
+func (nt *NavicatTunnel) echoNotice(w io.Writer, message string) error {
+	if _, err := w.Write(nt.EchoResultSetHeader(0, 0, 0, 0, 0)); err != nil {
+		return err
+	}
+	_, err := w.Write(nt.GetBlock(message))
+	return err
+}
+
+// echoQueryError writes a failed query's result set header and message and
+// records the failure in st
+func (nt *NavicatTunnel) echoQueryError(w io.Writer, queryErr error, st *QueryStats) error {
+	message := queryErr.Error()
+	if errors.Is(queryErr, context.DeadlineExceeded) && nt.QueryTimeout > 0 {
+		message = fmt.Sprintf("query exceeded the maximum execution time of %s", nt.QueryTimeout)
+	}
+	st.fail(1000, queryErr, message)
+
+	if _, err := w.Write(nt.EchoResultSetHeader(1000, 0, 0, 0, 0)); err != nil {
+		return err
+	}
+	_, err := w.Write(nt.GetBlock(message))
+	return err
+}
+
+// serveQuery handles the query action. It returns 202 if the request has
+// too many queries, 2000 if no connection could be made, 1000 if a query
+// failed and 0 otherwise.
+func (nt *NavicatTunnel) serveQuery(w http.ResponseWriter, r *http.Request, p ConnParams) uint32 {
+	queries := nt.RequestQueries(r.Form)
 	
-	return buf.Bytes()
+	start := time.Now()
+	if nt.MaxQueries > 0 && len(queries) > nt.MaxQueries {
+		message := fmt.Sprintf("too many queries in one request: %d, at most %d allowed", len(queries), nt.MaxQueries)
+		nt.Audit.Request(r, p, "Q", start, 202, message)
+		w.Write(nt.createErrorResponse(202, message))
+		return 202
+	}
+	conn, done, err := nt.connForRequest(w, r, p, queries)
+	if err != nil {
+		nt.Audit.Request(r, p, "Q", start, 2000, err.Error())
+		w.Write(nt.createErrorResponse(2000, err.Error()))
+		return 2000
+	}
+	
+	ctx := r.Context()
+	qc := nt.newQueryCanceler(ctx, conn, p)
+	sw := NewStreamWriter(w)
+	stats, err := nt.HandleQueryExecution(ctx, sw, conn, queries, nt.requestPolicy(r), qc)
+	// A cancelled statement leaves the connection unusable, as does one
+	// which was stopped by closing its connection
+	broken := ctx.Err() != nil
+	for _, st := range stats {
+		broken = broken || st.aborted
+	}
+	done(broken)
+	nt.Audit.Queries(r, p, stats)
+	var errno uint32
+	for _, st := range stats {
+		nt.Metrics.ObserveQuery(st)
+		if st.ErrorCode != 0 {
+			errno = 1000
+		}
+	}
+	if err != nil {
+		log.Printf("query response aborted: %v", err)
+		return 1000
+	}
+	sw.Flush()
+	return errno
 }
 
 // createErrorResponse creates an error response
@@ -620,7 +953,7 @@ func (nt *NavicatTunnel) GetTestPageHTML() string {
         #port{
             width: 75px;
         }
-        #login, #password, #db{
+        #login, #password, #db, #tunnel_token{
             width: 150px;
         }
         #Copyright{
@@ -704,6 +1037,7 @@ func (nt *NavicatTunnel) GetTestPageHTML() string {
         <tr><td>Username:</td><td><input type="text" id="login" placeholder="root"></td></tr>
         <tr><td>Password:</td><td><input type="password" id="password" placeholder=""></td></tr>
         <tr><td>Database:</td><td><input type="text" id="db" placeholder=""></td></tr>
+        <tr><td>Tunnel Token:</td><td><input type="password" id="tunnel_token" placeholder=""></td></tr>
         <tr><td></td><td><br><input type="submit" value="Test Connection" onClick="doServerTest()"></td></tr>
     </table>
     </form>
@@ -728,10 +1062,21 @@ func (nt *NavicatTunnel) GetTestPageHTML() string {
 // HTTP handler
 func (nt *NavicatTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		// Parse form data
+		// Parse form data, up to MaxBodySize. ParseForm caps other bodies
+		// at 10MB, so they are wrapped without a limit of their own.
+		limit := nt.MaxBodySize
+		if limit <= 0 {
+			limit = math.MaxInt64
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
 		err := r.ParseForm()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			err = fmt.Errorf("request body exceeds %d bytes", tooLarge.Limit)
+		}
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			w.Header().Set("Content-Type", "text/plain; charset=x-user-defined")
+			w.Write(nt.createErrorResponse(202, err.Error()))
 			return
 		}
 		
@@ -741,8 +1086,11 @@ func (nt *NavicatTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		port := r.Form.Get("port")
 		login := r.Form.Get("login")
 		
-		if action == "" || host == "" || port == "" || login == "" {
-			if !AllowTestMenu {
+		// A profile stands in for host, port and login
+		hasTarget := r.Form.Get("profile") != "" || (host != "" && port != "" && login != "")
+		
+		if action == "" || !hasTarget {
+			if !nt.TestMenu {
 				w.Header().Set("Content-Type", "text/plain; charset=x-user-defined")
 				response := nt.createErrorResponse(202, "invalid parameters")
 				w.Write(response)
@@ -757,25 +1105,74 @@ func (nt *NavicatTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		
 		// Handle actions
-		var response []byte
+		w.Header().Set("Content-Type", "text/plain; charset=x-user-defined")
+		start := time.Now()
+		rw := newResponseWriter(w, nt.WriteTimeout)
+		w = rw
+		var errno uint32
+		defer func() { nt.Metrics.ObserveRequest(action, errno, rw.written) }()
+		
+		// Client limits apply before authentication, so they also slow down
+		// credential guessing
+		release, err := nt.Limits.Acquire(clientIP(r), "", "")
+		if err != nil {
+			errno = 202
+			nt.rejectLimited(w, r, ConnParamsFromForm(r.Form), action, start, err)
+			return
+		}
+		defer release()
+		
+		// Check tunnel credentials
+		if nt.auth != nil {
+			user, ok := nt.auth.Authenticate(r)
+			if !ok {
+				errno = 202
+				nt.Audit.Request(r, ConnParamsFromForm(r.Form), action, start, 202, "tunnel authentication failed")
+				w.Write(nt.createErrorResponse(202, "tunnel authentication failed"))
+				return
+			}
+			r = r.WithContext(WithTunnelUser(r.Context(), user))
+		}
+		
+		// Resolve the upstream connection
+		p, err := nt.connParams(r)
+		if err != nil {
+			errno = 2000
+			nt.Audit.Request(r, ConnParamsFromForm(r.Form), action, start, 2000, err.Error())
+			w.Write(nt.createErrorResponse(2000, err.Error()))
+			return
+		}
+		release, err = nt.Limits.Acquire("", TunnelUser(r.Context()), net.JoinHostPort(p.Host, p.Port))
+		if err != nil {
+			errno = 202
+			nt.rejectLimited(w, r, p, action, start, err)
+			return
+		}
+		defer release()
 		
 		switch action {
 		case "C":
 			// Connection test
-			response = nt.HandleConnectionTest(r.Form)
+			response, err := nt.HandleConnectionTest(r.Context(), p)
+			if err != nil {
+				errno = 2000
+				nt.Audit.Request(r, p, action, start, 2000, err.Error())
+			} else {
+				nt.Audit.Request(r, p, action, start, 0, "")
+			}
+			w.Write(response)
 		case "Q":
-			// Query execution
-			response = nt.HandleQueryExecution(r.Form)
+			// Query execution, streamed as rows are read
+			errno = nt.serveQuery(w, r, p)
 		default:
-			response = nt.createErrorResponse(202, "invalid action")
+			errno = 202
+			nt.Audit.Request(r, p, action, start, 202, "invalid action")
+			w.Write(nt.createErrorResponse(202, "invalid action"))
 		}
 		
-		w.Header().Set("Content-Type", "text/plain; charset=x-user-defined")
-		w.Write(response)
-		
 	} else {
 		// GET request - show test page if allowed
-		if AllowTestMenu {
+		if nt.TestMenu {
 			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 			html := nt.GetTestPageHTML()
 			w.Write([]byte(html))
@@ -785,24 +1182,251 @@ func (nt *NavicatTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// rejectLimited answers a request refused by a limiter with an error block
+// and a Retry-After header
+func (nt *NavicatTunnel) rejectLimited(w http.ResponseWriter, r *http.Request, p ConnParams, action string, start time.Time, err error) {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		seconds := int64(math.Ceil(limitErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	}
+	nt.Audit.Request(r, p, action, start, 202, err.Error())
+	w.Write(nt.createErrorResponse(202, err.Error()))
+}
+
+// listenAddr turns a bare port number into a listen address
+func listenAddr(port string) string {
+	if !strings.Contains(port, ":") {
+		port = ":" + port
+	}
+	return port
+}
+
 func main() {
-	tunnel := NewNavicatTunnel()
+	cfg, printConfig, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = DefaultPort
+	if cfg.LogFile != "" {
+		logFile, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("opening log file: %v", err)
+		}
+		log.SetOutput(logFile)
 	}
-	if !strings.HasPrefix(port, ":") {
-		port = ":" + port
+	
+	// Upstream targets the tunnel may connect to
+	targets, err := cfg.TargetPolicy()
+	if err != nil {
+		log.Fatalf("invalid target policy: %v", err)
+	}
+	mysql.RegisterDialContext("tcp", targets.DialContext)
+	
+	// Upstream connection pools and session affinity
+	pools := NewPoolManager(cfg.PoolOptions())
+	sessions := NewSessionManager(cfg.SessionOptions(), pools)
+	
+	// Tunnel credentials, required unless explicitly turned off
+	var auth *Authenticator
+	if cfg.Auth.Enabled {
+		users := make(map[string]string)
+		if cfg.Auth.File != "" {
+			users, err = LoadAuthFile(cfg.Auth.File)
+			if err != nil {
+				log.Fatalf("reading tunnel auth file: %v", err)
+			}
+		}
+		if cfg.Auth.Token != "" {
+			users[DefaultTokenUser] = cfg.Auth.Token
+		}
+		if len(users) == 0 {
+			log.Fatal("no tunnel credentials configured")
+		}
+		auth = NewAuthenticator(users)
+	} else {
+		log.Printf("warning: tunnel authentication is turned off")
+	}
+	
+	tunnel := NewNavicatTunnel(pools, sessions, auth)
+	tunnel.TestMenu = cfg.TestMenu
+	tunnel.MultiStatements = cfg.Upstream.MultiStatements
+	tunnel.TimeZone = cfg.Upstream.TimeZone
+	tunnel.Charset = cfg.Upstream.Charset
+	tunnel.Collation = cfg.Upstream.Collation
+	if cfg.Upstream.TLSFile != "" {
+		names, err := RegisterUpstreamTLS(cfg.Upstream.TLSFile)
+		if err != nil {
+			log.Fatalf("registering upstream TLS configs: %v", err)
+		}
+		tunnel.TLSConfigs = names
+	}
+	tunnel.TLS = cfg.Upstream.TLS
+	tunnel.WriteTimeout = time.Duration(cfg.HTTP.WriteTimeout)
+	tunnel.MaxBodySize = int64(cfg.HTTP.MaxBodySizeMB) << 20
+	tunnel.MaxQueries = cfg.HTTP.MaxQueries
+	tunnel.Limits = cfg.RequestLimits()
+	tunnel.QueryTimeout = time.Duration(cfg.Upstream.QueryTimeout)
+	tunnel.KillOnCancel = cfg.Upstream.KillOnCancel
+	if cfg.Upstream.ProfilesFile != "" {
+		profiles, err := LoadProfiles(cfg.Upstream.ProfilesFile)
+		if err != nil {
+			log.Fatalf("reading connection profiles: %v", err)
+		}
+		tunnel.Profiles = profiles
+	}
+	tunnel.RequireProfile = cfg.Upstream.RequireProfile
+	tunnel.Policy, tunnel.UserPolicies = cfg.StatementPolicies()
+	tunnel.ResultLimit = cfg.ResultLimit()
+	tunnel.SpoolMaxSize = int64(cfg.Results.SpoolMaxSizeMB) << 20
+	var auditFile *RotatingFile
+	switch cfg.Audit.File {
+	case "":
+	case "stdout", "-":
+		tunnel.Audit = NewAuditLog(os.Stdout, cfg.Audit.Redact)
+	default:
+		auditFile, err = OpenRotatingFile(cfg.Audit.File, int64(cfg.Audit.MaxSizeMB)<<20, cfg.Audit.MaxBackups)
+		if err != nil {
+			log.Fatalf("opening audit log: %v", err)
+		}
+		tunnel.Audit = NewAuditLog(auditFile, cfg.Audit.Redact)
 	}
 	
-	fmt.Printf("Starting Navicat HTTP Tunnel (Go) on port %s\n", port)
-	fmt.Printf("Access: http://localhost%s\n", port)
+	// Routes: the tunnel, and metrics and probes on the same or an admin mux
+	mux := http.NewServeMux()
+	mux.Handle(cfg.TunnelPath, tunnel)
+	admin := mux
+	if cfg.AdminListen != "" {
+		admin = http.NewServeMux()
+	}
 	
-	// Setup HTTP server
-	http.Handle("/", tunnel)
+	// Metrics, read by Prometheus
+	if cfg.MetricsPath != "" {
+		tunnel.Metrics = NewMetrics()
+		tunnel.Metrics.Collect(pools.WritePoolMetrics)
+		tunnel.Metrics.Collect(sessions.WriteSessionMetrics)
+		tunnel.Metrics.Collect(tunnel.Limits.WriteMetrics)
+		var metrics http.Handler = tunnel.Metrics
+		if cfg.AdminListen == "" && auth != nil {
+			// Served next to the tunnel, so only to tunnel users
+			metrics = auth.RequireAuth(metrics)
+		}
+		admin.Handle(cfg.MetricsPath, metrics)
+	}
+	
+	// Liveness and readiness probes
+	var readyTarget *ConnParams
+	if name := cfg.Health.ReadyProfile; name != "" {
+		profile := tunnel.Profiles[name]
+		if profile == nil {
+			log.Fatalf("readiness profile %q is not defined", name)
+		}
+		// Pinged through the pool requests with the profile use
+		p := tunnel.ProfileParams(profile)
+		readyTarget = &p
+	}
+	health := NewHealth(pools, readyTarget, time.Duration(cfg.Health.ReadyTimeout))
+	if cfg.Health.LivePath != "" {
+		admin.HandleFunc(cfg.Health.LivePath, health.Live)
+	}
+	if cfg.Health.ReadyPath != "" {
+		admin.HandleFunc(cfg.Health.ReadyPath, health.Ready)
+	}
+	
+	// Requests are cancelled through this context if they outlast shutdown
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	baseContext := func(net.Listener) context.Context { return requestCtx }
+	
+	// Setup HTTP servers; a failing listener ends the process
+	port := cfg.Listen
+	server := &http.Server{Addr: port, Handler: mux, BaseContext: baseContext}
+	cfg.HTTP.apply(server)
+	servers := []*http.Server{server}
+	serveErr := make(chan error, 3)
+	serve := func(listen func() error) {
+		go func() {
+			if err := listen(); err != http.ErrServerClosed {
+				serveErr <- err
+			}
+		}()
+	}
+	
+	if cfg.AdminListen != "" {
+		adminServer := &http.Server{Addr: cfg.AdminListen, Handler: admin, BaseContext: baseContext}
+		cfg.HTTP.apply(adminServer)
+		servers = append(servers, adminServer)
+		fmt.Printf("Serving metrics and probes on port %s\n", cfg.AdminListen)
+		serve(adminServer.ListenAndServe)
+	}
 	
-	// Start server
-	log.Fatal(http.ListenAndServe(port, nil))
-}
\ No newline at end of file
+	// Serve HTTPS when a certificate is configured
+	if cfg.TLS.Cert == "" {
+		fmt.Printf("Starting Navicat HTTP Tunnel (Go) on port %s\n", port)
+		fmt.Printf("Access: http://localhost%s\n", port)
+		serve(server.ListenAndServe)
+	} else {
+		certs, err := NewCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			log.Fatalf("loading TLS certificate: %v", err)
+		}
+		server.TLSConfig, err = ServerTLSConfig(certs, cfg.TLS.ClientCA)
+		if err != nil {
+			log.Fatalf("loading TLS client CAs: %v", err)
+		}
+		go certs.Watch(time.Duration(cfg.TLS.ReloadInterval))
+		
+		if redirect := cfg.TLS.RedirectListen; redirect != "" {
+			redirectServer := &http.Server{Addr: redirect, Handler: RedirectHandler(port)}
+			cfg.HTTP.apply(redirectServer)
+			servers = append(servers, redirectServer)
+			fmt.Printf("Redirecting HTTP on port %s to HTTPS\n", redirect)
+			serve(redirectServer.ListenAndServe)
+		}
+		
+		fmt.Printf("Starting Navicat HTTP Tunnel (Go) on port %s\n", port)
+		fmt.Printf("Access: https://localhost%s\n", port)
+		serve(func() error { return server.ListenAndServeTLS("", "") })
+	}
+	
+	// Run until SIGTERM or SIGINT, then drain in-flight requests
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		log.Printf("received %v, shutting down", sig)
+		health.SetDraining()
+		if delay := time.Duration(cfg.ShutdownDelay); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-signals:
+			}
+		}
+	case err := <-serveErr:
+		log.Printf("server failed: %v", err)
+		exitCode = 1
+	}
+	
+	if !Shutdown(servers, cancelRequests, time.Duration(cfg.ShutdownTimeout), signals) {
+		exitCode = 1
+	}
+	cancelRequests()
+	sessions.Close()
+	pools.Close()
+	if auditFile != nil {
+		if err := auditFile.Close(); err != nil {
+			log.Printf("closing audit log: %v", err)
+		}
+	}
+	log.Printf("shutdown complete")
+	os.Exit(exitCode)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetMySQLTypeFromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want MySQLFieldType
+	}{
+		// Integers and their aliases
+		{"TINYINT", MYSQL_TYPE_TINY},
+		{"INT1", MYSQL_TYPE_TINY},
+		{"BOOL", MYSQL_TYPE_TINY},
+		{"BOOLEAN", MYSQL_TYPE_TINY},
+		{"SMALLINT", MYSQL_TYPE_SHORT},
+		{"INT2", MYSQL_TYPE_SHORT},
+		{"MEDIUMINT", MYSQL_TYPE_INT24},
+		{"MIDDLEINT", MYSQL_TYPE_INT24},
+		{"INT3", MYSQL_TYPE_INT24},
+		{"INT", MYSQL_TYPE_LONG},
+		{"INTEGER", MYSQL_TYPE_LONG},
+		{"INT4", MYSQL_TYPE_LONG},
+		{"BIGINT", MYSQL_TYPE_LONGLONG},
+		{"INT8", MYSQL_TYPE_LONGLONG},
+		{"SERIAL", MYSQL_TYPE_LONGLONG},
+
+		// Fixed and floating point
+		{"DECIMAL", MYSQL_TYPE_NEWDECIMAL},
+		{"DEC", MYSQL_TYPE_NEWDECIMAL},
+		{"NUMERIC", MYSQL_TYPE_NEWDECIMAL},
+		{"FIXED", MYSQL_TYPE_NEWDECIMAL},
+		{"FLOAT", MYSQL_TYPE_FLOAT},
+		{"FLOAT4", MYSQL_TYPE_FLOAT},
+		{"DOUBLE", MYSQL_TYPE_DOUBLE},
+		{"DOUBLE PRECISION", MYSQL_TYPE_DOUBLE},
+		{"REAL", MYSQL_TYPE_DOUBLE},
+		{"FLOAT8", MYSQL_TYPE_DOUBLE},
+		{"BIT", MYSQL_TYPE_BIT},
+
+		// Temporal
+		{"DATE", MYSQL_TYPE_DATE},
+		{"NEWDATE", MYSQL_TYPE_NEWDATE},
+		{"TIME", MYSQL_TYPE_TIME},
+		{"DATETIME", MYSQL_TYPE_DATETIME},
+		{"TIMESTAMP", MYSQL_TYPE_TIMESTAMP},
+		{"YEAR", MYSQL_TYPE_YEAR},
+
+		// Strings
+		{"CHAR", MYSQL_TYPE_STRING},
+		{"CHARACTER", MYSQL_TYPE_STRING},
+		{"NCHAR", MYSQL_TYPE_STRING},
+		{"BINARY", MYSQL_TYPE_STRING},
+		{"VARCHAR", MYSQL_TYPE_VAR_STRING},
+		{"CHARACTER VARYING", MYSQL_TYPE_VAR_STRING},
+		{"NVARCHAR", MYSQL_TYPE_VAR_STRING},
+		{"VARBINARY", MYSQL_TYPE_VAR_STRING},
+		{"ENUM", MYSQL_TYPE_ENUM},
+		{"SET", MYSQL_TYPE_SET},
+
+		// BLOB and TEXT by size class
+		{"TINYBLOB", MYSQL_TYPE_TINY_BLOB},
+		{"TINYTEXT", MYSQL_TYPE_TINY_BLOB},
+		{"BLOB", MYSQL_TYPE_BLOB},
+		{"TEXT", MYSQL_TYPE_BLOB},
+		{"MEDIUMBLOB", MYSQL_TYPE_MEDIUM_BLOB},
+		{"MEDIUMTEXT", MYSQL_TYPE_MEDIUM_BLOB},
+		{"LONG", MYSQL_TYPE_MEDIUM_BLOB},
+		{"LONG VARCHAR", MYSQL_TYPE_MEDIUM_BLOB},
+		{"LONGBLOB", MYSQL_TYPE_LONG_BLOB},
+		{"LONGTEXT", MYSQL_TYPE_LONG_BLOB},
+		{"JSON", MYSQL_TYPE_JSON},
+
+		// Spatial
+		{"GEOMETRY", MYSQL_TYPE_GEOMETRY},
+		{"POINT", MYSQL_TYPE_GEOMETRY},
+		{"LINESTRING", MYSQL_TYPE_GEOMETRY},
+		{"POLYGON", MYSQL_TYPE_GEOMETRY},
+		{"MULTIPOINT", MYSQL_TYPE_GEOMETRY},
+		{"MULTILINESTRING", MYSQL_TYPE_GEOMETRY},
+		{"MULTIPOLYGON", MYSQL_TYPE_GEOMETRY},
+		{"GEOMETRYCOLLECTION", MYSQL_TYPE_GEOMETRY},
+		{"GEOMCOLLECTION", MYSQL_TYPE_GEOMETRY},
+
+		{"VECTOR", MYSQL_TYPE_VECTOR},
+		{"NULL", MYSQL_TYPE_NULL},
+
+		// Lengths and attributes
+		{"tinyint(1)", MYSQL_TYPE_TINY},
+		{"INT(10) UNSIGNED", MYSQL_TYPE_LONG},
+		{"INT(10) UNSIGNED ZEROFILL", MYSQL_TYPE_LONG},
+		{"UNSIGNED INT", MYSQL_TYPE_LONG},
+		{"UNSIGNED BIGINT", MYSQL_TYPE_LONGLONG},
+		{"BIGINT SIGNED", MYSQL_TYPE_LONGLONG},
+		{"DECIMAL(10,2) UNSIGNED", MYSQL_TYPE_NEWDECIMAL},
+		{"DOUBLE PRECISION(8,3) ZEROFILL", MYSQL_TYPE_DOUBLE},
+		{"  float(7,4)  ", MYSQL_TYPE_FLOAT},
+		{"DATETIME(6)", MYSQL_TYPE_DATETIME},
+		{"VARCHAR(255)", MYSQL_TYPE_VAR_STRING},
+		{"VARCHAR(255) CHARACTER SET utf8mb4", MYSQL_TYPE_VAR_STRING},
+		{"VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin", MYSQL_TYPE_VAR_STRING},
+		{"CHAR(10) CHARSET latin1", MYSQL_TYPE_STRING},
+		{"TEXT COLLATE utf8mb4_unicode_ci", MYSQL_TYPE_BLOB},
+		{"CHARACTER(4) CHARACTER SET ascii", MYSQL_TYPE_STRING},
+		{"CHARACTER VARYING(20) CHARACTER SET gbk", MYSQL_TYPE_VAR_STRING},
+		{"NATIONAL CHAR(10)", MYSQL_TYPE_STRING},
+		{"NATIONAL VARCHAR(10)", MYSQL_TYPE_VAR_STRING},
+		{"NATIONAL CHARACTER VARYING(10)", MYSQL_TYPE_VAR_STRING},
+		{"ENUM('a','b')", MYSQL_TYPE_ENUM},
+		{"SET('x','y') CHARACTER SET latin1", MYSQL_TYPE_SET},
+		{"BINARY(16)", MYSQL_TYPE_STRING},
+		{"BIT(1)", MYSQL_TYPE_BIT},
+		{"VECTOR(3)", MYSQL_TYPE_VECTOR},
+		{"INT(10", MYSQL_TYPE_LONG},
+
+		// Unknown names
+		{"", MYSQL_TYPE_VAR_STRING},
+		{"UUID", MYSQL_TYPE_VAR_STRING},
+		{"INET6", MYSQL_TYPE_VAR_STRING},
+	}
+	nt := &NavicatTunnel{}
+	for _, tt := range tests {
+		if got := nt.GetMySQLTypeFromName(tt.name); got != tt.want {
+			t.Errorf("GetMySQLTypeFromName(%q) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetMySQLTypeFromNameCoversTypeNames(t *testing.T) {
+	nt := &NavicatTunnel{}
+	for name, want := range mysqlTypeNames {
+		if got := nt.GetMySQLTypeFromName(strings.ToLower(name)); got != want {
+			t.Errorf("GetMySQLTypeFromName(%q) = %d, want %d", strings.ToLower(name), got, want)
+		}
+	}
+}
+
+func TestGetBlockBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		prefix []byte
+	}{
+		{"empty", []byte{}, []byte{0}},
+		{"gbk", []byte{0xc4, 0xe3, 0xba, 0xc3}, []byte{4}},                // 你好
+		{"latin1", []byte{0x63, 0x61, 0x66, 0xe9}, []byte{4}},             // café
+		{"binary", []byte{0x00, 0xff, 0x00, 0xfe, 0xfb, 0x01}, []byte{6}}, // NUL, 0xFF and length prefix bytes
+		{"0xff only", []byte{0xff}, []byte{1}},                            // the NULL marker as data
+		{"invalid utf8", []byte{0xc3, 0x28, 0xa0, 0xa1, 0xe2, 0x82}, []byte{6}},
+		{"250 bytes", bytes.Repeat([]byte{0xff}, 250), []byte{250}},
+		{"251 bytes", bytes.Repeat([]byte{0x00}, 251), []byte{251}},
+		{"253 bytes", bytes.Repeat([]byte{0xb0, 0xa1}, 127)[:253], []byte{253}}, // gbk cut mid-character
+		{"254 bytes", bytes.Repeat([]byte{0xe9}, 254), []byte{0xfe, 0, 0, 0, 254}},
+		{"255 bytes", bytes.Repeat([]byte{0x00, 0xff}, 128)[:255], []byte{0xfe, 0, 0, 0, 255}},
+		{"65536 bytes", bytes.Repeat([]byte{0xfe}, 65536), []byte{0xfe, 0, 1, 0, 0}},
+	}
+	nt := &NavicatTunnel{}
+	for _, tt := range tests {
+		got := nt.GetBlockBytes(tt.data)
+		if !bytes.HasPrefix(got, tt.prefix) || !bytes.Equal(got[len(tt.prefix):], tt.data) {
+			t.Errorf("%s: GetBlockBytes = % x..., want prefix % x and the data unchanged", tt.name, head(got), tt.prefix)
+		}
+	}
+}
+
+// head returns up to the first 8 bytes of b
+func head(b []byte) []byte {
+	if len(b) > 8 {
+		return b[:8]
+	}
+	return b
+}
+
+func TestEchoDataPassesBytesThrough(t *testing.T) {
+	server := newFakeMySQL(t)
+	values := []string{
+		"\xc4\xe3\xba\xc3", // gbk
+		"caf\xe9",          // latin1
+		"\x00\xff\x00\xfe", // binary
+		string(bytes.Repeat([]byte{0xff}, 254)),
+	}
+	var row []*string
+	var columns []fakeColumn
+	for i := range values {
+		row = append(row, &values[i])
+		columns = append(columns, fakeColumn{name: "c", typ: MYSQL_TYPE_VAR_STRING, charset: BinaryCharset, length: 255})
+	}
+	row = append(row, nil)
+	columns = append(columns, fakeColumn{name: "n", typ: MYSQL_TYPE_VAR_STRING, charset: 28, length: 255})
+	server.respond("SELECT c", resultSetPackets(columns, [][]*string{row}, 2)...)
+
+	p := server.params()
+	p.Charset = "gbk"
+	db, err := p.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	nt := &NavicatTunnel{}
+	var buf bytes.Buffer
+	n, err := nt.EchoData(&buf, rows, make([]ColumnMeta, len(columns)))
+	if err != nil || n != 1 {
+		t.Fatalf("EchoData = %d, %v, want 1 row", n, err)
+	}
+	var want []byte
+	for _, v := range values {
+		want = append(want, nt.GetBlockBytes([]byte(v))...)
+	}
+	want = append(want, 0xff)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("EchoData wrote % x, want % x", buf.Bytes(), want)
+	}
+}
+
+func TestConnParamsTLS(t *testing.T) {
+	nt := &NavicatTunnel{
+		TLS:        "rds",
+		TLSConfigs: map[string]bool{"rds": true, "mtls": true},
+		Profiles: map[string]*Profile{
+			"pinned": {Name: "pinned", Host: "db1", TLS: "rds"},
+			"open":   {Name: "open", Host: "db2"},
+		},
+	}
+	tests := []struct {
+		form    string
+		want    string
+		wantErr bool
+	}{
+		{"host=db", "rds", false},
+		{"host=db&tls=mtls", "mtls", false},
+		{"host=db&tls=false", "", true},
+		{"host=db&tls=skip-verify", "", true},
+		{"host=db&tls=preferred", "", true},
+		{"host=db&tls=true", "", true},
+		{"host=db&tls=other", "", true},
+		{"profile=pinned", "rds", false},
+		{"profile=pinned&tls=false", "rds", false},
+		{"profile=pinned&tls=mtls", "rds", false},
+		{"profile=open", "rds", false},
+		{"profile=open&tls=mtls", "mtls", false},
+		{"profile=open&tls=skip-verify", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		p, err := nt.connParams(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.form, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.TLS != tt.want {
+			t.Errorf("%s: TLS = %q, want %q", tt.form, p.TLS, tt.want)
+		}
+	}
+}
+
+func TestProfileParamsMatchRequests(t *testing.T) {
+	nt := &NavicatTunnel{
+		TLS:             "rds",
+		TimeZone:        "+00:00",
+		Charset:         "latin1",
+		MultiStatements: true,
+		Policy:          &StatementPolicy{ReadOnly: true},
+		Profiles: map[string]*Profile{
+			"main":    {Name: "main", Host: "db1", User: "app", Password: "pw", Database: "shop"},
+			"replica": {Name: "replica", Host: "db2", User: "ro", Charset: "gbk", Collation: "gbk_bin", TLS: "mtls"},
+		},
+	}
+	for name, profile := range nt.Profiles {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("profile="+name))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		want, err := nt.connParams(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nt.ProfileParams(profile); got.Key() != want.Key() || got != want {
+			t.Errorf("%s: ProfileParams = %+v, want the request's %+v", name, got, want)
+		}
+	}
+}
+
+func TestTruncatedResultStopsStatement(t *testing.T) {
+	server := newFakeMySQL(t)
+	// Far more than socket buffers hold, so the server only gets rid of it
+	// all if the client reads it
+	value := strings.Repeat("x", 200)
+	rows := make([][]*string, 200000)
+	for i := range rows {
+		rows[i] = []*string{&value}
+	}
+	columns := []fakeColumn{{name: "v", typ: MYSQL_TYPE_VAR_STRING, charset: 28, length: 800}}
+	server.respond("SELECT big", resultSetPackets(columns, rows, 2)...)
+
+	tests := []struct {
+		name     string
+		nt       *NavicatTunnel
+		kill     bool // stop the statement with KILL QUERY rather than closing the connection
+		wantRows uint64
+		wantFail bool
+	}{
+		{"truncate", &NavicatTunnel{ResultLimit: ResultLimit{MaxRows: 10}}, true, 10, false},
+		{"fail", &NavicatTunnel{ResultLimit: ResultLimit{MaxRows: 10, Fail: true}}, true, 10, true},
+		{"spool full", &NavicatTunnel{SpoolMaxSize: 1 << 20}, true, 0, true},
+		{"truncate without kill", &NavicatTunnel{ResultLimit: ResultLimit{MaxRows: 10}}, false, 10, false},
+		{"spool full without kill", &NavicatTunnel{SpoolMaxSize: 1 << 20}, false, 0, true},
+	}
+	for _, tt := range tests {
+		db, err := server.params().Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var qc *QueryCanceler
+		if tt.kill {
+			if qc = tt.nt.newQueryCanceler(context.Background(), conn, server.params()); qc == nil {
+				t.Fatalf("%s: no query canceler", tt.name)
+			}
+		}
+
+		var buf bytes.Buffer
+		stats, err := tt.nt.HandleQueryExecution(context.Background(), &buf, conn, []string{"SELECT big", "SELECT 1"}, nil, qc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != 2 || stats[0].Rows != tt.wantRows || stats[0].Truncated != (tt.wantRows > 0) {
+			t.Fatalf("%s: stats = %+v, want the first query cut short after %d rows", tt.name, stats, tt.wantRows)
+		}
+		if (stats[0].ErrorCode != 0) != tt.wantFail {
+			t.Errorf("%s: error code of the first query = %d", tt.name, stats[0].ErrorCode)
+		}
+
+		if tt.kill {
+			if stats[1].ErrorCode != 0 || stats[0].aborted {
+				t.Errorf("%s: stats = %+v, want the query after the first one run on the same connection", tt.name, stats)
+			}
+			select {
+			case <-server.kills:
+			default:
+				t.Errorf("%s: the statement was not killed", tt.name)
+			}
+			if err := conn.PingContext(context.Background()); err != nil {
+				t.Errorf("%s: connection unusable after the statement was killed: %v", tt.name, err)
+			}
+		} else {
+			if !stats[0].aborted || stats[1].Error != errAbortedConn.Error() {
+				t.Errorf("%s: stats = %+v, want the query after the first one not run", tt.name, stats)
+			}
+			if !strings.Contains(buf.String(), "its connection was closed") {
+				t.Errorf("%s: response does not tell the connection was closed", tt.name)
+			}
+			select {
+			case <-server.dropped:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: the client read the rest of the result set instead of dropping the connection", tt.name)
+			}
+		}
+		conn.Close()
+		db.Close()
+	}
+}
+
+func TestServeHTTPBodySize(t *testing.T) {
+	// Beyond the 10MB ParseForm applies to bodies without a limit
+	large := "actn=Q&q%5B%5D=" + strings.Repeat("x", 11<<20)
+	tests := []struct {
+		name    string
+		limit   int64
+		body    string
+		wantErr string
+	}{
+		{"no limit", 0, large, "invalid parameters"},
+		{"within the limit", 12 << 20, large, "invalid parameters"},
+		{"beyond the limit", 1 << 20, large, "request body exceeds 1048576 bytes"},
+		{"malformed", 0, "actn=%zz", "invalid URL escape"},
+	}
+	for _, tt := range tests {
+		nt := &NavicatTunnel{MaxBodySize: tt.limit}
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		nt.ServeHTTP(w, r)
+
+		body := w.Body.String()
+		if w.Code != 200 || !strings.HasPrefix(body, string(nt.EchoHeader(202))) || !strings.Contains(body, tt.wantErr) {
+			t.Errorf("%s: response %d %.80q, want an error block with %q", tt.name, w.Code, body, tt.wantErr)
+		}
+	}
+}
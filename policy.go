@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StatementClass groups statements by what they may change
+type StatementClass string
+
+const (
+	// ClassRead covers queries, SHOW, transaction control and session settings
+	ClassRead StatementClass = "read"
+	// ClassDML covers data changes, including CALL and LOCK TABLES
+	ClassDML StatementClass = "dml"
+	// ClassDDL covers schema changes
+	ClassDDL StatementClass = "ddl"
+	// ClassDCL covers accounts, roles and privileges
+	ClassDCL StatementClass = "dcl"
+	// ClassAdmin covers server administration and anything not recognised
+	ClassAdmin StatementClass = "admin"
+)
+
+// StatementClasses lists every statement class
+var StatementClasses = []StatementClass{ClassRead, ClassDML, ClassDDL, ClassDCL, ClassAdmin}
+
+// readStatements are leading keywords of statements which change no data
+var readStatements = map[string]bool{
+	"BEGIN": true, "COMMIT": true, "DEALLOCATE": true, "DO": true, "EXECUTE": true,
+	"HELP": true, "RELEASE": true, "ROLLBACK": true, "SAVEPOINT": true, "SHOW": true, "UNLOCK": true, "USE": true, "XA": true,
+}
+
+// dmlStatements are leading keywords of statements which change data
+var dmlStatements = map[string]bool{
+	"CALL": true, "DELETE": true, "HANDLER": true, "INSERT": true, "LOCK": true,
+	"REPLACE": true, "UPDATE": true,
+}
+
+// StatementClassOf classifies a query, which may hold several statements,
+// by the most privileged of them
+func StatementClassOf(query string) StatementClass {
+	class := ClassRead
+	for _, c := range statementClasses(query) {
+		if classRank(c) > classRank(class) {
+			class = c
+		}
+	}
+	return class
+}
+
+// statementClasses classifies each statement of a query. Whether a
+// backslash escapes a quote depends on the session's sql_mode, so the query
+// is read each way the server might read it and the statements found in any
+// reading count. Text holding no statement at all, such as a lone comment,
+// is admin class, as the server may see more in it than the lexer does.
+func statementClasses(query string) []StatementClass {
+	var classes []StatementClass
+	for _, escapes := range []string{escapesDefault, escapesANSIQuotes, escapesNoBackslash} {
+		stmts := splitStatements(query, escapes)
+		if len(stmts) == 0 && strings.TrimSpace(query) != "" {
+			return []StatementClass{ClassAdmin}
+		}
+		for _, stmt := range stmts {
+			classes = append(classes, classifyTokens(lexSQLEscapes(stmt, escapes), escapes))
+		}
+	}
+	return classes
+}
+
+// classRank orders the classes from read to admin
+func classRank(c StatementClass) int {
+	for i, class := range StatementClasses {
+		if class == c {
+			return i
+		}
+	}
+	return len(StatementClasses)
+}
+
+// word returns the upper-cased keyword at tokens[i], or "" if there is none
+func word(tokens []sqlToken, i int) string {
+	if i < len(tokens) && tokens[i].kind == tokWord {
+		return strings.ToUpper(tokens[i].text)
+	}
+	return ""
+}
+
+// hasWord reports whether keyword appears anywhere in tokens
+func hasWord(tokens []sqlToken, keyword string) bool {
+	for _, t := range tokens {
+		if t.is(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyTokens classifies a single statement, lexed with backslash
+// escapes inside the given quotes. A statement which does not start with a
+// keyword is admin class.
+func classifyTokens(tokens []sqlToken, escapes string) StatementClass {
+	first := firstKeyword(tokens)
+	if first < 0 {
+		return ClassAdmin
+	}
+	keyword := word(tokens, first)
+	rest := tokens[first+1:]
+
+	switch keyword {
+	case "SELECT", "TABLE", "VALUES":
+		if hasWord(rest, "OUTFILE") || hasWord(rest, "DUMPFILE") {
+			return ClassAdmin
+		}
+		return ClassRead
+	case "WITH":
+		// The statement the common table expressions belong to
+		depth := 0
+		for i, t := range rest {
+			switch {
+			case t.is("("):
+				depth++
+			case t.is(")"):
+				depth--
+			case depth == 0 && (t.is("SELECT") || t.is("TABLE") || t.is("VALUES") ||
+				t.is("INSERT") || t.is("REPLACE") || t.is("UPDATE") || t.is("DELETE")):
+				return classifyTokens(rest[i:], escapes)
+			}
+		}
+		return ClassAdmin
+	case "EXPLAIN", "DESC", "DESCRIBE":
+		// EXPLAIN ANALYZE, and its synonyms, run the statement
+		if word(rest, 0) == "ANALYZE" {
+			return classifyTokens(rest[1:], escapes)
+		}
+		return ClassRead
+	case "ANALYZE":
+		switch word(rest, 0) {
+		case "TABLE", "TABLES", "LOCAL", "NO_WRITE_TO_BINLOG":
+			return ClassAdmin
+		}
+		// MariaDB's ANALYZE runs the statement
+		return classifyTokens(rest, escapes)
+	case "CHECK", "CHECKSUM":
+		if w := word(rest, 0); w == "TABLE" || w == "TABLES" {
+			return ClassRead
+		}
+		return ClassAdmin
+	case "START":
+		if word(rest, 0) == "TRANSACTION" {
+			if hasWord(rest, "WRITE") {
+				// Overrides a read-only session
+				return ClassAdmin
+			}
+			return ClassRead
+		}
+		return ClassAdmin
+	case "SET":
+		return classifySet(rest, escapes)
+	case "LOAD":
+		if w := word(rest, 0); w == "DATA" || w == "XML" {
+			return ClassDML
+		}
+		return ClassAdmin
+	case "CREATE", "ALTER", "DROP", "RENAME":
+		object := word(rest, 0)
+		if object == "OR" && word(rest, 1) == "REPLACE" {
+			object = word(rest, 2)
+		}
+		switch object {
+		case "USER", "ROLE":
+			return ClassDCL
+		case "INSTANCE", "SERVER", "RESOURCE":
+			return ClassAdmin
+		}
+		return ClassDDL
+	case "TRUNCATE", "IMPORT":
+		return ClassDDL
+	case "GRANT", "REVOKE":
+		return ClassDCL
+	case "PREPARE":
+		// PREPARE name FROM 'statement'
+		if len(rest) == 3 && rest[1].is("FROM") && rest[2].kind == tokString {
+			return StatementClassOf(unquote(rest[2].text, escapes))
+		}
+		return ClassAdmin
+	}
+	switch {
+	case readStatements[keyword]:
+		return ClassRead
+	case dmlStatements[keyword]:
+		return ClassDML
+	}
+	return ClassAdmin
+}
+
+// classifySet classifies SET statements. Session variables and transaction
+// characteristics are read class, except for turning off read-only mode and
+// changing sql_mode, which decides how statements are lexed.
+func classifySet(rest []sqlToken, escapes string) StatementClass {
+	switch word(rest, 0) {
+	case "PASSWORD", "DEFAULT":
+		return ClassDCL
+	case "RESOURCE":
+		return ClassAdmin
+	case "ROLE":
+		return ClassRead
+	}
+	depth := 0
+	for i, t := range rest {
+		text := strings.ToLower(t.text)
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case t.is("GLOBAL") || t.is("PERSIST") || t.is("PERSIST_ONLY"):
+			return ClassAdmin
+		case t.kind == tokVariable && (strings.HasPrefix(text, "@@global.") || strings.HasPrefix(text, "@@persist")):
+			return ClassAdmin
+		case strings.HasSuffix(text, "transaction_read_only") || strings.HasSuffix(text, "tx_read_only"):
+			return ClassAdmin
+		case strings.HasSuffix(text, "sql_mode"):
+			return ClassAdmin
+		case t.is("WRITE"):
+			// SET TRANSACTION READ WRITE
+			return ClassAdmin
+		case depth == 0 && t.is("FOR") && word(rest, 0) == "STATEMENT":
+			// MariaDB's SET STATEMENT var = value FOR statement
+			return classifyTokens(rest[i+1:], escapes)
+		}
+	}
+	return ClassRead
+}
+
+// unquote returns the contents of a string literal as the server reads it,
+// with backslash escapes decoded if its quote is one of escapes
+func unquote(s, escapes string) string {
+	if len(s) < 2 {
+		return s
+	}
+	q := s[0]
+	body := s[1 : len(s)-1]
+	backslash := strings.IndexByte(escapes, q) >= 0
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == q && i+1 < len(body) && body[i+1] == q:
+			i++
+		case c == '\\' && backslash && i+1 < len(body):
+			i++
+			c = body[i]
+			switch c {
+			case '0':
+				c = 0
+			case 'b':
+				c = '\b'
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'Z':
+				c = 0x1a
+			case '%', '_':
+				// Kept escaped for LIKE patterns
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// StatementPolicy limits the statement classes a tunnel user or connection
+// profile may run
+type StatementPolicy struct {
+	Allow []string `json:"allow" yaml:"allow" toml:"allow"` // all classes if empty
+	Deny  []string `json:"deny" yaml:"deny" toml:"deny"`
+	// ReadOnly runs sessions with SET SESSION TRANSACTION READ ONLY, so the
+	// server refuses data changes the classification misses, such as ones made
+	// by stored functions. Admin statements, which could turn it off, are
+	// denied.
+	ReadOnly bool `json:"read_only" yaml:"read_only" toml:"read_only"`
+}
+
+// Validate checks the class names
+func (sp *StatementPolicy) Validate() error {
+	for _, name := range append(sp.Allow[:len(sp.Allow):len(sp.Allow)], sp.Deny...) {
+		if classRank(StatementClass(name)) == len(StatementClasses) {
+			return fmt.Errorf("unknown statement class %q", name)
+		}
+	}
+	return nil
+}
+
+// permits reports whether the policy allows a statement class
+func (sp *StatementPolicy) permits(class StatementClass) bool {
+	if sp.ReadOnly && class == ClassAdmin {
+		return false
+	}
+	for _, name := range sp.Deny {
+		if StatementClass(name) == class {
+			return false
+		}
+	}
+	if len(sp.Allow) == 0 {
+		return true
+	}
+	for _, name := range sp.Allow {
+		if StatementClass(name) == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy is the combination of the statement policies applying to a
+// request. A statement must be permitted by each of them.
+type Policy []*StatementPolicy
+
+// Check returns an error if the query holds a statement the policy denies
+func (pol Policy) Check(query string) error {
+	if len(pol) == 0 {
+		return nil
+	}
+	for _, class := range statementClasses(query) {
+		for _, sp := range pol {
+			if !sp.permits(class) {
+				return fmt.Errorf("%s statements are not permitted", strings.ToUpper(string(class)))
+			}
+		}
+	}
+	return nil
+}
+
+// ReadOnly reports whether sessions must be read-only
+func (pol Policy) ReadOnly() bool {
+	for _, sp := range pol {
+		if sp.ReadOnly {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package main
+
+import "testing"
+
+func TestStatementClassOf(t *testing.T) {
+	tests := []struct {
+		query string
+		want  StatementClass
+	}{
+		{"SELECT 1", ClassRead},
+		{"  ", ClassRead},
+		{"SHOW TABLES", ClassRead},
+		{"SELECT * FROM t INTO OUTFILE '/tmp/x'", ClassAdmin},
+		{"DELETE FROM t", ClassDML},
+		{"WITH x AS (SELECT 1) DELETE FROM t", ClassDML},
+		{"CREATE TABLE t (id INT)", ClassDDL},
+		{"CREATE USER u", ClassDCL},
+		{"SET NAMES utf8mb4", ClassRead},
+		{"SET GLOBAL max_connections = 10", ClassAdmin},
+		{"SET SESSION TRANSACTION READ WRITE", ClassAdmin},
+		{"PREPARE s FROM 'DROP TABLE t'", ClassDDL},
+		{"PREPARE s FROM 'SELECT 1'", ClassRead},
+		{"PREPARE s FROM @q", ClassAdmin},
+		{"EXECUTE s", ClassRead},
+
+		// Prepared statements are decoded the way the server would read the
+		// string. Left undecoded, as with NO_BACKSLASH_ESCAPES, a backslash
+		// before the first keyword makes them admin class.
+		{`PREPARE s FROM '/\* x */ DELETE FROM t'`, ClassAdmin},
+		{`PREPARE s FROM "\/* x */ DROP TABLE t"`, ClassAdmin},
+		{`PREPARE s FROM 'SELECT ''a''; DELETE FROM t'`, ClassDML},
+		{`PREPARE s FROM 'SELECT "a\""; DROP TABLE t'`, ClassDDL},
+
+		// Statements that don't start with a keyword
+		{"/ DELETE FROM t", ClassAdmin},
+		{"\\ SELECT 1", ClassAdmin},
+		{"(SELECT 1)", ClassRead},
+
+		// EXPLAIN ANALYZE and its synonyms run the statement
+		{"EXPLAIN SELECT 1", ClassRead},
+		{"EXPLAIN DELETE FROM t", ClassRead},
+		{"EXPLAIN ANALYZE DELETE FROM t", ClassDML},
+		{"DESC t", ClassRead},
+		{"DESCRIBE t", ClassRead},
+		{"DESC SELECT 1", ClassRead},
+		{"DESC ANALYZE DELETE t FROM t JOIN u ON t.a = u.a", ClassDML},
+		{"DESCRIBE ANALYZE UPDATE t SET a = 1", ClassDML},
+		{"describe analyze select 1", ClassRead},
+		{"SELECT 1; DROP TABLE t", ClassDDL},
+
+		// Executable comments
+		{"/*! DELETE FROM t */", ClassDML},
+		{"/*!50000 DELETE FROM t */", ClassDML},
+		{"/*M! DELETE FROM t */", ClassDML},
+		{"/*M!100100 DROP TABLE t */", ClassDDL},
+		{"SELECT 1 /*M!; DROP TABLE t */", ClassDDL},
+		{"/* DELETE FROM t */ SELECT 1", ClassRead},
+
+		// Text without statements
+		{"/* comment */", ClassAdmin},
+		{"-- comment", ClassAdmin},
+		{";", ClassAdmin},
+
+		// sql_mode changes how later statements are lexed
+		{"SET sql_mode = 'NO_BACKSLASH_ESCAPES'", ClassAdmin},
+		{"SET SESSION sql_mode = 'ANSI_QUOTES'", ClassAdmin},
+		{"SET @@sql_mode = ''", ClassAdmin},
+		{"SET @@session.sql_mode = 'ANSI'", ClassAdmin},
+		{"SET STATEMENT sql_mode = '' FOR SELECT 1", ClassAdmin},
+		{"SET STATEMENT max_statement_time = 1 FOR DELETE FROM t", ClassDML},
+		{"SET STATEMENT max_statement_time = (SELECT 1 FOR UPDATE) FOR SELECT 1", ClassRead},
+
+		// A backslash before a quote ends the string with NO_BACKSLASH_ESCAPES
+		{`SELECT 'a\'; DROP TABLE t; -- '`, ClassDDL},
+		// and inside double quotes with ANSI_QUOTES
+		{`SELECT "a\"; DELETE FROM t; -- "`, ClassDML},
+		{`SELECT 'a\\', 'b'`, ClassRead},
+	}
+	for _, tt := range tests {
+		if got := StatementClassOf(tt.query); got != tt.want {
+			t.Errorf("StatementClassOf(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	readOnly := Policy{{Allow: []string{"read"}}}
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"SELECT 1", true},
+		{"", true},
+		{"/*M! DELETE FROM t */", false},
+		{"/* nothing */", false},
+		{`PREPARE s FROM '/\* x */ DELETE FROM t'`, false},
+		{"PREPARE s FROM 'SELECT 1'", true},
+		{"DESC ANALYZE DELETE t FROM t JOIN u ON t.a = u.a", false},
+		{"DESCRIBE ANALYZE UPDATE t SET a = 1", false},
+		{"SET sql_mode = 'NO_BACKSLASH_ESCAPES'", false},
+		{`SELECT 'x\'; DELETE FROM t; -- '`, false},
+	}
+	for _, tt := range tests {
+		if err := readOnly.Check(tt.query); (err == nil) != tt.ok {
+			t.Errorf("Check(%q) = %v, want ok %v", tt.query, err, tt.ok)
+		}
+	}
+	if err := (Policy{}).Check("/*M! DELETE FROM t */"); err != nil {
+		t.Errorf("empty policy denied a query: %v", err)
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		literal, escapes, want string
+	}{
+		{`'abc'`, escapesDefault, "abc"},
+		{`'it''s'`, escapesDefault, "it's"},
+		{`"say ""hi"""`, escapesDefault, `say "hi"`},
+		{`'/\* x */ DELETE'`, escapesDefault, "/* x */ DELETE"},
+		{`'/\* x */ DELETE'`, escapesNoBackslash, `/\* x */ DELETE`},
+		{`'a\'b'`, escapesDefault, "a'b"},
+		{`'a\\b'`, escapesDefault, `a\b`},
+		{`'\0\b\n\r\t\Z'`, escapesDefault, "\x00\b\n\r\t\x1a"},
+		{`'100\%'`, escapesDefault, `100\%`},
+		{`'a\_b'`, escapesDefault, `a\_b`},
+		{`"\/x"`, escapesDefault, "/x"},
+		{`"\/x"`, escapesANSIQuotes, `\/x`},
+		{`'\/x'`, escapesANSIQuotes, "/x"},
+		{`''`, escapesDefault, ""},
+	}
+	for _, tt := range tests {
+		if got := unquote(tt.literal, tt.escapes); got != tt.want {
+			t.Errorf("unquote(%s, %q) = %q, want %q", tt.literal, tt.escapes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Connection pool defaults
+const (
+	DefaultCharset         = "utf8mb4"
+	DefaultPoolIdleTimeout = 5 * time.Minute
+	DefaultPoolMaxConns    = 10
+	DefaultPoolMaxIdle     = 2
+	DefaultPoolMaxPools    = 64
+)
+
+// ConnParams identifies an upstream MySQL server and the account used on it
+type ConnParams struct {
+	Host      string
+	Port      string
+	User      string
+	Password  string
+	Database  string
+	Charset   string // connection character set, e.g. "gbk" or "binary"
+	Collation string // connection collation, the charset's default if empty
+	TLS       string // name of a registered TLS config or a driver built-in
+
+	MultiStatements bool
+	TimeZone        string // session time_zone, e.g. "+00:00" or "Europe/Berlin"
+	ReadOnly        bool   // run sessions with SET SESSION TRANSACTION READ ONLY
+}
+
+// ConnParamsFromForm reads connection parameters from a tunnel request. The
+// TLS config is left to the tunnel, which checks the requested name.
+func ConnParamsFromForm(params url.Values) ConnParams {
+	p := ConnParams{
+		Host:      params.Get("host"),
+		Port:      params.Get("port"),
+		User:      params.Get("login"),
+		Password:  params.Get("password"),
+		Database:  params.Get("db"),
+		Charset:   params.Get("charset"),
+		Collation: params.Get("collation"),
+	}
+	if p.Host == "" {
+		p.Host = "localhost"
+	}
+	if p.Port == "" {
+		p.Port = "3306"
+	}
+	return p
+}
+
+// Config builds the driver configuration for these parameters
+func (p ConnParams) Config() *mysql.Config {
+	cfg := mysql.NewConfig()
+	cfg.User = p.User
+	cfg.Passwd = p.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(p.Host, p.Port)
+	cfg.DBName = p.Database
+	cfg.TLSConfig = p.TLS
+	charset := p.Charset
+	if charset == "" {
+		charset = DefaultCharset
+	}
+	if p.Collation != "" {
+		// The driver sends SET NAMES with the charset as it is
+		charset += " COLLATE " + p.Collation
+	}
+	cfg.Params = map[string]string{"charset": charset}
+	if p.TimeZone != "" {
+		cfg.Params["time_zone"] = "'" + strings.ReplaceAll(p.TimeZone, "'", "''") + "'"
+	}
+	// Temporal values are passed on as the server formats them, which keeps
+	// fractional seconds, zero dates and TIME values beyond 24 hours intact
+	cfg.ParseTime = false
+	// Keep table names in the column definitions for the fields header. The
+	// driver then also prefixes them to the column names, which only
+	// DriverColumnMeta gets around.
+	cfg.ColumnsWithAlias = driverLayoutKnown
+	cfg.MultiStatements = p.MultiStatements
+	return cfg
+}
+
+// Validate checks the parameters which end up in statements the driver sends
+func (p ConnParams) Validate() error {
+	charset := p.Charset
+	if charset == "" {
+		charset = DefaultCharset
+	} else if err := validCharset(charset); err != nil {
+		return err
+	}
+	if p.Collation != "" {
+		return validCollation(p.Collation, charset)
+	}
+	return nil
+}
+
+// Key identifies the pool for these parameters. The password only enters the
+// key through a hash of the full DSN.
+func (p ConnParams) Key() string {
+	sum := sha256.Sum256([]byte(p.Config().FormatDSN()))
+	key := fmt.Sprintf("%s@%s:%s/%s#%x", p.User, p.Host, p.Port, p.Database, sum[:8])
+	if p.ReadOnly {
+		key += "#ro"
+	}
+	return key
+}
+
+// Open creates a new database handle for these parameters
+func (p ConnParams) Open() (*sql.DB, error) {
+	connector, err := mysql.NewConnector(p.Config())
+	if err != nil {
+		return nil, err
+	}
+	if p.ReadOnly {
+		connector = readOnlyConnector{connector}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// readOnlyConnector makes every new connection read-only before use
+type readOnlyConnector struct {
+	driver.Connector
+}
+
+func (c readOnlyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("driver connection cannot execute statements")
+	}
+	if _, err := execer.ExecContext(ctx, "SET SESSION TRANSACTION READ ONLY", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// PoolOptions controls how long-lived upstream connection pools are kept
+type PoolOptions struct {
+	IdleTimeout time.Duration // close a pool unused for this long
+	MaxConns    int           // max open connections per pool
+	MaxIdle     int           // max idle connections per pool
+	MaxPools    int           // max pools kept, least recently used are evicted
+}
+
+// DefaultPoolOptions returns the built-in pool settings
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{
+		IdleTimeout: DefaultPoolIdleTimeout,
+		MaxConns:    DefaultPoolMaxConns,
+		MaxIdle:     DefaultPoolMaxIdle,
+		MaxPools:    DefaultPoolMaxPools,
+	}
+}
+
+type poolEntry struct {
+	db       *sql.DB
+	refs     int
+	lastUsed time.Time
+}
+
+// PoolManager keeps one *sql.DB per upstream server and account so that
+// consecutive tunnel requests reuse established MySQL connections.
+type PoolManager struct {
+	opts     PoolOptions
+	mu       sync.Mutex
+	pools    map[string]*poolEntry
+	failures uint64      // failed connection attempts
+	retired  sql.DBStats // counters of closed pools
+	done     chan struct{}
+}
+
+// NewPoolManager creates a pool manager and starts its idle eviction loop
+func NewPoolManager(opts PoolOptions) *PoolManager {
+	pm := &PoolManager{
+		opts:  opts,
+		pools: make(map[string]*poolEntry),
+		done:  make(chan struct{}),
+	}
+	go pm.janitor()
+	return pm
+}
+
+// Acquire returns a live database handle for p. The handle stays valid until
+// release is called.
+func (pm *PoolManager) Acquire(ctx context.Context, p ConnParams) (db *sql.DB, release func(), err error) {
+	if err := p.Validate(); err != nil {
+		return nil, nil, err
+	}
+	key := p.Key()
+
+	pm.mu.Lock()
+	e, ok := pm.pools[key]
+	if !ok {
+		db, err := p.Open()
+		if err != nil {
+			pm.failures++
+			pm.mu.Unlock()
+			return nil, nil, err
+		}
+		db.SetMaxOpenConns(pm.opts.MaxConns)
+		db.SetMaxIdleConns(pm.opts.MaxIdle)
+		db.SetConnMaxIdleTime(pm.opts.IdleTimeout)
+
+		pm.evictLRU()
+		e = &poolEntry{db: db}
+		pm.pools[key] = e
+	}
+	e.refs++
+	e.lastUsed = time.Now()
+	pm.mu.Unlock()
+
+	release = func() {
+		pm.mu.Lock()
+		e.refs--
+		e.lastUsed = time.Now()
+		pm.mu.Unlock()
+	}
+
+	if err := e.db.PingContext(ctx); err != nil {
+		pm.mu.Lock()
+		pm.failures++
+		pm.mu.Unlock()
+		release()
+		if !ok {
+			// Don't keep pools around for unreachable servers or bad logins
+			pm.remove(key, e)
+		}
+		return nil, nil, err
+	}
+	return e.db, release, nil
+}
+
+// Stats returns the number of pools, their combined statistics and the
+// number of failed connection attempts so far
+func (pm *PoolManager) Stats() (pools int, stats sql.DBStats, failures uint64) {
+	pm.mu.Lock()
+	dbs := make([]*sql.DB, 0, len(pm.pools))
+	for _, e := range pm.pools {
+		dbs = append(dbs, e.db)
+	}
+	failures = pm.failures
+	stats = pm.retired
+	pm.mu.Unlock()
+
+	for _, db := range dbs {
+		s := db.Stats()
+		stats.MaxOpenConnections += s.MaxOpenConnections
+		stats.OpenConnections += s.OpenConnections
+		stats.InUse += s.InUse
+		stats.Idle += s.Idle
+		addCounters(&stats, s)
+	}
+	return len(dbs), stats, failures
+}
+
+// addCounters adds the cumulative counters of s to total
+func addCounters(total *sql.DBStats, s sql.DBStats) {
+	total.WaitCount += s.WaitCount
+	total.WaitDuration += s.WaitDuration
+	total.MaxIdleClosed += s.MaxIdleClosed
+	total.MaxIdleTimeClosed += s.MaxIdleTimeClosed
+	total.MaxLifetimeClosed += s.MaxLifetimeClosed
+}
+
+// retire closes a pool in the background, keeping its counters for Stats.
+// The caller must hold pm.mu and have removed the entry.
+func (pm *PoolManager) retire(e *poolEntry) {
+	addCounters(&pm.retired, e.db.Stats())
+	go e.db.Close()
+}
+
+// remove drops an unused pool entry
+func (pm *PoolManager) remove(key string, e *poolEntry) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.pools[key] == e && e.refs == 0 {
+		delete(pm.pools, key)
+		pm.retire(e)
+	}
+}
+
+// evictLRU closes the least recently used idle pool once MaxPools is
+// reached. The caller must hold pm.mu.
+func (pm *PoolManager) evictLRU() {
+	if pm.opts.MaxPools <= 0 || len(pm.pools) < pm.opts.MaxPools {
+		return
+	}
+	var oldestKey string
+	var oldest *poolEntry
+	for key, e := range pm.pools {
+		if e.refs == 0 && (oldest == nil || e.lastUsed.Before(oldest.lastUsed)) {
+			oldestKey, oldest = key, e
+		}
+	}
+	if oldest != nil {
+		delete(pm.pools, oldestKey)
+		pm.retire(oldest)
+	}
+}
+
+// evictIdle closes pools which have not been used for IdleTimeout
+func (pm *PoolManager) evictIdle() {
+	if pm.opts.IdleTimeout <= 0 {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	deadline := time.Now().Add(-pm.opts.IdleTimeout)
+	for key, e := range pm.pools {
+		if e.refs == 0 && e.lastUsed.Before(deadline) {
+			delete(pm.pools, key)
+			pm.retire(e)
+		}
+	}
+}
+
+func (pm *PoolManager) janitor() {
+	interval := pm.opts.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pm.evictIdle()
+		case <-pm.done:
+			return
+		}
+	}
+}
+
+// Close stops the eviction loop and closes every pool
+func (pm *PoolManager) Close() error {
+	close(pm.done)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for key, e := range pm.pools {
+		delete(pm.pools, key)
+		e.db.Close()
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestConnParamsValidate(t *testing.T) {
+	tests := []struct {
+		charset, collation string
+		ok                 bool
+	}{
+		{"", "", true},
+		{"utf8mb4", "", true},
+		{"gbk", "", true},
+		{"latin1", "", true},
+		{"binary", "", true},
+		{"UTF8", "", true},
+		{"utf8mb4_0900_ai_ci", "", false},
+		{"gbk_chinese_ci", "", false},
+		{"utf8mb4,latin1", "", false},
+		{"utf8mb4 ", "", false},
+		{"gbk'", "", false},
+		{"gbk;SET GLOBAL x=1", "", false},
+		{"utf-8", "", false},
+		{"latin1\x00", "", false},
+		{"gbk\xa3", "", false},
+		{"", "utf8mb4_0900_ai_ci", true},
+		{"gbk", "gbk_bin", true},
+		{"binary", "binary", true},
+		{"utf8", "utf8mb3_general_ci", true},
+		{"utf8mb3", "utf8_unicode_ci", true},
+		{"gbk", "GBK_CHINESE_CI", true},
+		{"gbk", "utf8mb4_bin", false},
+		{"", "latin1_swedish_ci", false},
+		{"latin1", "latin1", false},
+		{"latin1", "latin1_bin;", false},
+		{"latin1", "latin1_made_up_ci", false},
+	}
+	for _, tt := range tests {
+		err := ConnParams{Charset: tt.charset, Collation: tt.collation}.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("Validate with charset %q and collation %q: err = %v, want ok %v", tt.charset, tt.collation, err, tt.ok)
+		}
+	}
+}
+
+func TestConnParamsConfigCharset(t *testing.T) {
+	tests := []struct {
+		charset, collation, want string
+	}{
+		{"", "", DefaultCharset},
+		{"gbk", "", "gbk"},
+		{"latin1", "", "latin1"},
+		{"binary", "", "binary"},
+		{"gbk", "gbk_bin", "gbk COLLATE gbk_bin"},
+		{"", "utf8mb4_bin", DefaultCharset + " COLLATE utf8mb4_bin"},
+	}
+	for _, tt := range tests {
+		p := ConnParams{Charset: tt.charset, Collation: tt.collation}
+		if got := p.Config().Params["charset"]; got != tt.want {
+			t.Errorf("Config with charset %q and collation %q: charset = %q, want %q", tt.charset, tt.collation, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Profile is a named upstream connection defined on the server, so that
+// clients select it by name and never send database credentials
+type Profile struct {
+	Name         string   `json:"-"`
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	User         string   `json:"user"`
+	Password     string   `json:"password"`
+	PasswordFile string   `json:"password_file"` // read instead of password
+	Database     string   `json:"db"`            // default database
+	Charset      string   `json:"charset"`
+	Collation    string   `json:"collation"`
+	TLS          string   `json:"tls"`   // upstream TLS config name
+	Users        []string `json:"users"` // tunnel users allowed, all if empty
+
+	Policy *StatementPolicy `json:"policy"` // statements allowed through the profile
+}
+
+// LoadProfiles reads connection profiles from a JSON file mapping profile
+// names to their settings
+func LoadProfiles(path string) (map[string]*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]*Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for name, p := range profiles {
+		if p == nil || p.Host == "" || p.User == "" {
+			return nil, fmt.Errorf("%s: profile %q needs a host and user", path, name)
+		}
+		p.Name = name
+		if p.Policy != nil {
+			if err := p.Policy.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: profile %q: %v", path, name, err)
+			}
+		}
+		if p.PasswordFile != "" {
+			secret, err := os.ReadFile(p.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: %v", name, err)
+			}
+			p.Password = strings.TrimRight(string(secret), "\r\n")
+		}
+	}
+	return profiles, nil
+}
+
+// Permits reports whether a tunnel user may connect through the profile
+func (p *Profile) Permits(user string) bool {
+	if len(p.Users) == 0 {
+		return true
+	}
+	for _, u := range p.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnParams returns the connection parameters of the profile
+func (p *Profile) ConnParams() ConnParams {
+	params := ConnParams{
+		Host:      p.Host,
+		Port:      "3306",
+		User:      p.User,
+		Password:  p.Password,
+		Database:  p.Database,
+		Charset:   p.Charset,
+		Collation: p.Collation,
+		TLS:       p.TLS,
+	}
+	if p.Port != 0 {
+		params.Port = strconv.Itoa(p.Port)
+	}
+	return params
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("from-file\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"profiles", `{
+  "main": {"host": "db1", "user": "app", "password": "pw", "db": "shop", "users": ["alice"]},
+  "replica": {"host": "db2", "port": 3307, "user": "ro", "password_file": "` + secretFile + `",
+    "policy": {"allow": ["read"], "read_only": true}}
+}`, ""},
+		{"missing host", `{"main": {"user": "app"}}`, `profile "main" needs a host and user`},
+		{"missing user", `{"main": {"host": "db1"}}`, `profile "main" needs a host and user`},
+		{"null profile", `{"main": null}`, `profile "main" needs a host and user`},
+		{"policy class", `{"main": {"host": "db1", "user": "app", "policy": {"deny": ["write"]}}}`, `profile "main": unknown statement class "write"`},
+		{"password file", `{"main": {"host": "db1", "user": "app", "password_file": "` + filepath.Join(dir, "missing") + `"}}`, `profile "main":`},
+		{"syntax", `{"main": {"host": "db1",}}`, "invalid character"},
+		{"wrong type", `{"main": {"host": "db1", "user": "app", "port": "3306"}}`, "cannot unmarshal string"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "profiles.json")
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		profiles, err := LoadProfiles(path)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want one containing %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		primary, replica := profiles["main"], profiles["replica"]
+		if primary == nil || replica == nil || len(profiles) != 2 {
+			t.Fatalf("%s: profiles = %v", tt.name, profiles)
+		}
+		want := ConnParams{Host: "db1", Port: "3306", User: "app", Password: "pw", Database: "shop"}
+		if got := primary.ConnParams(); got != want {
+			t.Errorf("main: ConnParams = %+v, want %+v", got, want)
+		}
+		want = ConnParams{Host: "db2", Port: "3307", User: "ro", Password: "from-file"}
+		if got := replica.ConnParams(); got != want {
+			t.Errorf("replica: ConnParams = %+v, want %+v", got, want)
+		}
+		if primary.Name != "main" || primary.Policy != nil {
+			t.Errorf("main: name %q, policy %+v", primary.Name, primary.Policy)
+		}
+		if replica.Policy == nil || !replica.Policy.ReadOnly || len(replica.Policy.Allow) != 1 {
+			t.Errorf("replica: policy = %+v", replica.Policy)
+		}
+		if !primary.Permits("alice") || primary.Permits("bob") || !replica.Permits("bob") {
+			t.Error("Permits does not follow the users lists")
+		}
+	}
+}
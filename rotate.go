@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an append-only file which is renamed to name.1 once it
+// reaches maxSize bytes, shifting older files to name.2 and so on and
+// keeping at most maxBackups of them.
+type RotatingFile struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens name for appending. A maxSize of zero never rotates.
+func OpenRotatingFile(name string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past maxSize. If
+// rotating fails, p is still appended to the current file and the rotation
+// error is returned along with its length.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		rotateErr = rf.rotate()
+		if rf.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("rotating %s: %w", rf.name, rotateErr)
+	}
+	return n, err
+}
+
+// rotate shifts the backups and starts a new file. If shifting fails, the
+// current file is opened again, so writes go on to it. The caller must hold
+// rf.mu.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	rf.file = nil
+	if err == nil {
+		err = rf.shift()
+	}
+	if openErr := rf.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shift renames the current file to name.1, moving older backups up one
+// place, or removes it if no backups are kept
+func (rf *RotatingFile) shift() error {
+	if rf.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rf.name, rf.maxBackups))
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.name, i), fmt.Sprintf("%s.%d", rf.name, i+1))
+		}
+		return os.Rename(rf.name, rf.name+".1")
+	}
+	return os.Remove(rf.name)
+}
+
+// Close closes the current file
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFile returns the content of name, or "" if it does not exist
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		want       []string // the file, then its backups
+	}{
+		{"no rotation", 0, 2, []string{"aaaabbbbccccdddd", "", ""}},
+		{"backups", 8, 2, []string{"ccccdddd", "aaaabbbb", ""}},
+		{"oldest backup removed", 4, 2, []string{"dddd", "cccc", "bbbb"}},
+		{"no backups", 8, 0, []string{"ccccdddd", "", ""}},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(t.TempDir(), "audit.log")
+		rf, err := OpenRotatingFile(name, tt.maxSize, tt.maxBackups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"aaaa", "bbbb", "cccc", "dddd"} {
+			if n, err := rf.Write([]byte(p)); n != len(p) || err != nil {
+				t.Fatalf("%s: Write(%q) = %d, %v", tt.name, p, n, err)
+			}
+		}
+		if err := rf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range tt.want {
+			file := name
+			if i > 0 {
+				file = fmt.Sprintf("%s.%d", name, i)
+			}
+			if got := readFile(t, file); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, filepath.Base(file), got, want)
+			}
+		}
+	}
+}
+
+func TestRotatingFileKeepsAppendingWhenRotationFails(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := OpenRotatingFile(name, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	// A directory in the way of the backup, which cannot be removed as it is
+	// not empty
+	if err := os.MkdirAll(filepath.Join(name+".1", "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rf.Write([]byte("aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := rf.Write([]byte("bbbb"))
+	if n != 4 || err == nil {
+		t.Errorf("Write with a failed rotation = %d, %v, want 4 and the rotation error", n, err)
+	}
+	if got := readFile(t, name); got != "aaaabbbb" {
+		t.Errorf("file = %q, want both writes in it", got)
+	}
+
+	// Rotation works again once the way is clear
+	if err := os.RemoveAll(name + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write([]byte("cccc")); err != nil {
+		t.Fatal(err)
+	}
+	if got, backup := readFile(t, name), readFile(t, name+".1"); got != "cccc" || backup != "aaaabbbb" {
+		t.Errorf("after rotating, file = %q and backup = %q", got, backup)
+	}
+}
+
+func TestRotatingFileClosed(t *testing.T) {
+	rf, err := OpenRotatingFile(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write([]byte("x")); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v, want %v", err, os.ErrClosed)
+	}
+}
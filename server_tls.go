@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultCertReloadInterval is how often certificate files are checked for
+// changes
+const DefaultCertReloadInterval = time.Minute
+
+// CertReloader serves a certificate and key from disk and picks up renewed
+// files without a restart, either on SIGHUP or when their modification time
+// changes.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// NewCertReloader loads the certificate pair once and fails if it is unusable
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload reads the certificate pair again. The current certificate stays in
+// use if the files cannot be loaded.
+func (cr *CertReloader) Reload() error {
+	modTime := cr.filesModTime()
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+// filesModTime returns the latest modification time of the two files
+func (cr *CertReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Watch reloads the certificate on SIGHUP and whenever the files change,
+// checking every interval. It never returns.
+func (cr *CertReloader) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			cr.mu.RLock()
+			unchanged := !cr.filesModTime().After(cr.modTime)
+			cr.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := cr.Reload(); err != nil {
+			log.Printf("reloading TLS certificate: %v", err)
+		} else {
+			log.Printf("reloaded TLS certificate from %s", cr.certFile)
+		}
+	}
+}
+
+// ServerTLSConfig builds the listener's TLS configuration. If clientCA is
+// set, clients must present a certificate signed by one of its CAs.
+func ServerTLSConfig(cr *CertReloader, clientCA string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCA)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// RedirectHandler sends plain HTTP requests to the same URL on the HTTPS
+// listener at httpsAddr
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			// IPv6 addresses keep their brackets without a port too
+			host = "[" + host + "]"
+		}
+		// Form posts must be repeated against HTTPS with their body
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		httpsAddr, method, host string
+		wantCode                int
+		wantLocation            string
+	}{
+		{":443", "GET", "tunnel.example.com", 301, "https://tunnel.example.com/ntunnel?x=1"},
+		{":443", "GET", "tunnel.example.com:80", 301, "https://tunnel.example.com/ntunnel?x=1"},
+		{":8443", "GET", "tunnel.example.com:8080", 301, "https://tunnel.example.com:8443/ntunnel?x=1"},
+		{":8443", "POST", "10.0.0.1", 308, "https://10.0.0.1:8443/ntunnel?x=1"},
+		{":443", "GET", "[::1]", 301, "https://[::1]/ntunnel?x=1"},
+		{":443", "GET", "[::1]:80", 301, "https://[::1]/ntunnel?x=1"},
+		{":8443", "GET", "[2001:db8::1]", 301, "https://[2001:db8::1]:8443/ntunnel?x=1"},
+		{":8443", "POST", "[2001:db8::1]:8080", 308, "https://[2001:db8::1]:8443/ntunnel?x=1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/ntunnel?x=1", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		RedirectHandler(tt.httpsAddr).ServeHTTP(w, r)
+		if w.Code != tt.wantCode || w.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("%s %s via %s: %d to %q, want %d to %q", tt.method, tt.host, tt.httpsAddr,
+				w.Code, w.Header().Get("Location"), tt.wantCode, tt.wantLocation)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session defaults
+const (
+	SessionCookieName         = "NTUNNEL_SESSION"
+	SessionFormField          = "session"
+	SessionHeader             = "X-Tunnel-Session"
+	DefaultSessionIdleTimeout = 10 * time.Minute
+	DefaultMaxSessions        = 256
+	DefaultMaxSessionsPerKey  = 4
+)
+
+// SessionOptions controls session affinity
+type SessionOptions struct {
+	Enabled     bool
+	IdleTimeout time.Duration // close a session unused for this long
+	MaxSessions int           // max sessions in total
+	MaxPerKey   int           // max sessions per upstream server and account
+}
+
+// DefaultSessionOptions returns the built-in session settings
+func DefaultSessionOptions() SessionOptions {
+	return SessionOptions{
+		Enabled:     true,
+		IdleTimeout: DefaultSessionIdleTimeout,
+		MaxSessions: DefaultMaxSessions,
+		MaxPerKey:   DefaultMaxSessionsPerKey,
+	}
+}
+
+// Session pins one MySQL connection to a client token, so that user
+// variables, temporary tables, the current database and open transactions
+// carry over from one tunnel request to the next.
+type Session struct {
+	ID       string
+	key      string
+	conn     *sql.Conn
+	release  func()
+	lock     chan struct{}
+	lastUsed time.Time
+	closed   bool
+}
+
+// SessionManager tracks the open sessions
+type SessionManager struct {
+	opts     SessionOptions
+	pools    *PoolManager
+	mu       sync.Mutex
+	sessions map[string]*Session
+	done     chan struct{}
+}
+
+// NewSessionManager creates a session manager and starts its idle eviction loop
+func NewSessionManager(opts SessionOptions, pools *PoolManager) *SessionManager {
+	sm := &SessionManager{
+		opts:     opts,
+		pools:    pools,
+		sessions: make(map[string]*Session),
+		done:     make(chan struct{}),
+	}
+	go sm.janitor()
+	return sm
+}
+
+// newSessionID generates a random session token
+func newSessionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Checkout returns the session with the given id. If id is unknown or
+// belongs to other connection parameters, it returns a new session when
+// create is set and nil otherwise. The session is held exclusively until
+// Checkin; concurrent requests of one session queue up. A nil session
+// without error means there is no session to use or no session slot is free.
+func (sm *SessionManager) Checkout(ctx context.Context, id string, p ConnParams, create bool) (*Session, error) {
+	key := p.Key()
+
+	sm.mu.Lock()
+	s := sm.sessions[id]
+	sm.mu.Unlock()
+
+	if s != nil && s.key == key {
+		select {
+		case s.lock <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !s.closed {
+			if err := s.conn.PingContext(ctx); err == nil {
+				return s, nil
+			}
+			sm.drop(s)
+		}
+		<-s.lock
+	}
+
+	if !create {
+		return nil, nil
+	}
+	return sm.create(ctx, p, key)
+}
+
+// create opens a session with a dedicated connection
+func (sm *SessionManager) create(ctx context.Context, p ConnParams, key string) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	sm.mu.Lock()
+	if !sm.makeRoom(key) {
+		sm.mu.Unlock()
+		return nil, nil
+	}
+	s := &Session{ID: id, key: key, lock: make(chan struct{}, 1), lastUsed: time.Now()}
+	s.lock <- struct{}{}
+	sm.sessions[id] = s
+	sm.mu.Unlock()
+
+	db, release, err := sm.pools.Acquire(ctx, p)
+	if err == nil {
+		s.conn, err = db.Conn(ctx)
+		if err != nil {
+			release()
+		}
+	}
+	if err != nil {
+		sm.mu.Lock()
+		delete(sm.sessions, id)
+		sm.mu.Unlock()
+		return nil, err
+	}
+	s.release = release
+	return s, nil
+}
+
+// makeRoom evicts idle sessions until a new one for key fits within the
+// limits. It reports false if every session in the way is busy. The caller
+// must hold sm.mu.
+func (sm *SessionManager) makeRoom(key string) bool {
+	for {
+		var total, perKey int
+		var oldest, oldestForKey *Session
+		for _, s := range sm.sessions {
+			total++
+			idle := len(s.lock) == 0
+			if idle && (oldest == nil || s.lastUsed.Before(oldest.lastUsed)) {
+				oldest = s
+			}
+			if s.key == key {
+				perKey++
+				if idle && (oldestForKey == nil || s.lastUsed.Before(oldestForKey.lastUsed)) {
+					oldestForKey = s
+				}
+			}
+		}
+
+		switch {
+		case sm.opts.MaxPerKey > 0 && perKey >= sm.opts.MaxPerKey:
+			if oldestForKey == nil {
+				return false
+			}
+			sm.evict(oldestForKey)
+		case sm.opts.MaxSessions > 0 && total >= sm.opts.MaxSessions:
+			if oldest == nil {
+				return false
+			}
+			sm.evict(oldest)
+		default:
+			return true
+		}
+	}
+}
+
+// evict removes an idle session and closes it in the background. It reports
+// false if the session was checked out in the meantime. The caller must hold
+// sm.mu.
+func (sm *SessionManager) evict(s *Session) bool {
+	select {
+	case s.lock <- struct{}{}:
+	default:
+		return false
+	}
+	delete(sm.sessions, s.ID)
+	go func() {
+		sm.close(s)
+		<-s.lock
+	}()
+	return true
+}
+
+// Checkin hands a session back after a request. Sessions removed while they
+// were checked out are closed here.
+func (sm *SessionManager) Checkin(s *Session) {
+	sm.mu.Lock()
+	s.lastUsed = time.Now()
+	orphaned := sm.sessions[s.ID] != s
+	sm.mu.Unlock()
+	if orphaned {
+		sm.close(s)
+	}
+	<-s.lock
+}
+
+// drop removes a checked out session whose connection is unusable
+func (sm *SessionManager) drop(s *Session) {
+	sm.mu.Lock()
+	if sm.sessions[s.ID] == s {
+		delete(sm.sessions, s.ID)
+	}
+	sm.mu.Unlock()
+	sm.close(s)
+}
+
+// close discards the session's connection instead of returning it to the
+// pool, so its state cannot leak into other requests. The caller must hold
+// the session lock.
+func (sm *SessionManager) close(s *Session) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	discardConn(s.conn)
+	s.release()
+}
+
+// discardConn closes a connection's underlying network connection rather
+// than returning it to the pool
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
+
+// evictIdle closes sessions which have not been used for IdleTimeout
+func (sm *SessionManager) evictIdle() {
+	if sm.opts.IdleTimeout <= 0 {
+		return
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	deadline := time.Now().Add(-sm.opts.IdleTimeout)
+	for _, s := range sm.sessions {
+		if s.lastUsed.Before(deadline) {
+			sm.evict(s)
+		}
+	}
+}
+
+func (sm *SessionManager) janitor() {
+	interval := sm.opts.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sm.evictIdle()
+		case <-sm.done:
+			return
+		}
+	}
+}
+
+// Close stops the eviction loop and closes every session
+func (sm *SessionManager) Close() error {
+	close(sm.done)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, s := range sm.sessions {
+		if !sm.evict(s) {
+			// Closed by Checkin once its request is done
+			delete(sm.sessions, s.ID)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of open sessions
+func (sm *SessionManager) Len() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return len(sm.sessions)
+}
+
+// requestSessionID returns the session token a request carries, if any
+func requestSessionID(r *http.Request) string {
+	if id := r.Form.Get(SessionFormField); id != "" {
+		return id
+	}
+	if c, err := r.Cookie(SessionCookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// connForRequest returns the connection a query request runs on. With
+// sessions enabled it is the connection pinned to the request's session, and
+// the session token is sent back in a cookie and the X-Tunnel-Session
+// header. A session is only started for queries which leave state behind on
+// their connection, so clients that never send the token back do not use up
+// the session slots. Otherwise, or when no session slot is free, a
+// connection is taken from the pool for the duration of the request. The
+// returned done function must be called once the request is finished; pass
+// true if the connection is unusable, which drops the session. Pool
+// connections are also discarded when the queries may have changed their
+// state.
+func (nt *NavicatTunnel) connForRequest(w http.ResponseWriter, r *http.Request, p ConnParams, queries []string) (*sql.Conn, func(discard bool), error) {
+	if nt.sessions != nil && nt.sessions.opts.Enabled {
+		s, err := nt.sessions.Checkout(r.Context(), requestSessionID(r), p, changesConnState(queries))
+		if err != nil {
+			return nil, nil, err
+		}
+		if s != nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     SessionCookieName,
+				Value:    s.ID,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+			})
+			w.Header().Set(SessionHeader, s.ID)
+			return s.conn, func(broken bool) {
+				if broken {
+					nt.sessions.drop(s)
+				}
+				nt.sessions.Checkin(s)
+			}, nil
+		}
+	}
+
+	db, release, err := nt.pools.Acquire(r.Context(), p)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := db.Conn(r.Context())
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return conn, func(broken bool) {
+		if broken || changesConnState(queries) {
+			discardConn(conn)
+		} else {
+			conn.Close()
+		}
+		release()
+	}, nil
+}
+
+// changesConnState reports whether queries may leave variables, temporary
+// tables, another current database or an open transaction behind on their
+// connection
+func changesConnState(queries []string) bool {
+	for _, query := range queries {
+		tokens := lexSQL(query)
+		first := firstKeyword(tokens)
+		if first < 0 {
+			continue
+		}
+		if ClassifyStatement(query) != StatementReturnsRows {
+			return true
+		}
+		for _, t := range tokens {
+			if t.is(":=") || t.is("INTO") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shutdown defaults
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	// ShutdownGrace is how long cancelled requests get to write their error
+	// responses before connections are closed
+	ShutdownGrace = 5 * time.Second
+)
+
+// Shutdown stops servers from accepting requests and waits up to timeout for
+// the running ones to finish. Requests still running then are cancelled
+// through cancel, which kills their statements on the MySQL server and ends
+// their responses with an error block instead of cutting them off. A second
+// signal on sig cancels them right away. Shutdown reports whether every
+// request finished on its own.
+func Shutdown(servers []*http.Server, cancel context.CancelFunc, timeout time.Duration, sig <-chan os.Signal) bool {
+	ctx, stop := context.WithTimeout(context.Background(), timeout+ShutdownGrace)
+	defer stop()
+
+	var cancelled atomic.Bool
+	cancelRequests := func(reason string) {
+		if !cancelled.Swap(true) {
+			log.Printf("%s, cancelling in-flight requests", reason)
+			cancel()
+		}
+	}
+	timer := time.AfterFunc(timeout, func() { cancelRequests("shutdown timeout reached") })
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-sig:
+			cancelRequests("received second signal")
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				failed.Store(true)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	return !cancelled.Load() && !failed.Load()
+}
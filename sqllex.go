@@ -0,0 +1,309 @@
+package main
+
+import (
+	"strings"
+)
+
+// sqlTokenKind is the kind of a lexical SQL token
+type sqlTokenKind int
+
+const (
+	tokWord        sqlTokenKind = iota // keyword or unquoted identifier
+	tokQuotedIdent                     // `identifier`
+	tokString                          // 'string' or "string"
+	tokNumber                          // numeric literal
+	tokVariable                        // @user or @@system variable
+	tokPunct                           // operator or punctuation
+)
+
+// sqlToken is one lexical token of a statement
+type sqlToken struct {
+	kind  sqlTokenKind
+	text  string
+	start int // byte offset of the token in the query
+	end   int
+}
+
+// is reports whether the token is the given keyword or punctuation
+func (t sqlToken) is(s string) bool {
+	switch t.kind {
+	case tokWord:
+		return strings.EqualFold(t.text, s)
+	case tokPunct:
+		return t.text == s
+	}
+	return false
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// Quotes in which a backslash escapes the next character, for each sql_mode
+// which changes how strings are read
+const (
+	escapesDefault     = `'"`
+	escapesANSIQuotes  = `'` // double quotes enclose identifiers
+	escapesNoBackslash = ""  // NO_BACKSLASH_ESCAPES
+)
+
+// lexSQL splits a query into tokens the way the MySQL server reads it:
+// whitespace and comments are dropped, while the contents of executable
+// comments (/*! ... */, and MariaDB's /*M! ... */) are kept as regular
+// tokens.
+func lexSQL(query string) []sqlToken {
+	return lexSQLEscapes(query, escapesDefault)
+}
+
+// lexSQLEscapes is lexSQL with backslash escapes only inside the given quotes
+func lexSQLEscapes(query, escapes string) []sqlToken {
+	var tokens []sqlToken
+	inExecComment := false
+	n := len(query)
+
+	for i := 0; i < n; {
+		c := query[i]
+		switch {
+		case isSpace(c):
+			i++
+
+		case c == '#' || (c == '-' && i+1 < n && query[i+1] == '-' && (i+2 == n || isSpace(query[i+2]))):
+			for i < n && query[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			if !inExecComment && (strings.HasPrefix(query[i+2:], "!") || strings.HasPrefix(query[i+2:], "M!")) {
+				// Executable comment, optionally with a version number
+				i += strings.IndexByte(query[i:], '!') + 1
+				for i < n && query[i] >= '0' && query[i] <= '9' {
+					i++
+				}
+				inExecComment = true
+				continue
+			}
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = n
+			} else {
+				i += end + 4
+			}
+
+		case c == '*' && inExecComment && i+1 < n && query[i+1] == '/':
+			inExecComment = false
+			i += 2
+
+		case c == '\'' || c == '"' || c == '`':
+			start := i
+			i++
+			for i < n {
+				if query[i] == '\\' && strings.IndexByte(escapes, c) >= 0 {
+					i += 2
+					continue
+				}
+				if query[i] == c {
+					if i+1 < n && query[i+1] == c {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			if i < n {
+				i++
+			} else {
+				i = n
+			}
+			kind := tokString
+			if c == '`' {
+				kind = tokQuotedIdent
+			}
+			tokens = append(tokens, sqlToken{kind: kind, text: query[start:i], start: start, end: i})
+
+		case c == '@':
+			start := i
+			i++
+			if i < n && query[i] == '@' {
+				i++
+			}
+			for i < n && (isWordChar(query[i]) || query[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: tokVariable, text: query[start:i], start: start, end: i})
+
+		case c >= '0' && c <= '9':
+			start := i
+			for i < n && (isWordChar(query[i]) || query[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: tokNumber, text: query[start:i], start: start, end: i})
+
+		case isWordChar(c):
+			start := i
+			for i < n && isWordChar(query[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: tokWord, text: query[start:i], start: start, end: i})
+
+		default:
+			start := i
+			i++
+			if c == ':' && i < n && query[i] == '=' {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: tokPunct, text: query[start:i], start: start, end: i})
+		}
+	}
+
+	return tokens
+}
+
+// firstKeyword returns the index of the first word of a statement, skipping
+// opening parentheses as in "(SELECT ...)". It returns -1 if there is none.
+func firstKeyword(tokens []sqlToken) int {
+	for i, t := range tokens {
+		if t.is("(") {
+			continue
+		}
+		if t.kind == tokWord {
+			return i
+		}
+		return -1
+	}
+	return -1
+}
+
+// hasTopLevelWord reports whether keyword appears outside parentheses
+func hasTopLevelWord(tokens []sqlToken, keyword string) bool {
+	depth := 0
+	for _, t := range tokens {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth <= 0 && t.is(keyword):
+			return true
+		}
+	}
+	return false
+}
+
+// SplitStatements splits a query at semicolons outside strings and comments,
+// dropping empty statements
+func SplitStatements(query string) []string {
+	return splitStatements(query, escapesDefault)
+}
+
+// splitStatements is SplitStatements with backslash escapes only inside the
+// given quotes
+func splitStatements(query, escapes string) []string {
+	var stmts []string
+	start, empty := 0, true
+	for _, t := range lexSQLEscapes(query, escapes) {
+		if t.is(";") {
+			if !empty {
+				stmts = append(stmts, strings.TrimSpace(query[start:t.start]))
+			}
+			start, empty = t.end, true
+			continue
+		}
+		empty = false
+	}
+	if !empty {
+		stmts = append(stmts, strings.TrimSpace(query[start:]))
+	}
+	return stmts
+}
+
+// StatementResult says whether a statement produces a result set
+type StatementResult int
+
+const (
+	// StatementMayReturnRows is used when only executing the statement tells
+	StatementMayReturnRows StatementResult = iota
+	// StatementReturnsRows marks statements answered with a result set
+	StatementReturnsRows
+	// StatementNoRows marks statements answered with an OK packet
+	StatementNoRows
+)
+
+// rowStatements are leading keywords of statements that return rows
+var rowStatements = map[string]bool{
+	"SELECT": true, "SHOW": true, "DESCRIBE": true, "DESC": true, "EXPLAIN": true,
+	"TABLE": true, "VALUES": true, "HELP": true,
+}
+
+// tableMaintenance are statements which return a status result set when
+// followed by TABLE, e.g. CHECK TABLE
+var tableMaintenance = map[string]bool{
+	"ANALYZE": true, "CHECK": true, "CHECKSUM": true, "OPTIMIZE": true, "REPAIR": true,
+}
+
+// noRowStatements are leading keywords of statements answered with an OK
+// packet only. Anything not listed here or above is run as a query and
+// classified by whether it returns columns.
+var noRowStatements = map[string]bool{
+	"ALTER": true, "BEGIN": true, "BINLOG": true, "CACHE": true, "CHANGE": true,
+	"COMMIT": true, "CREATE": true, "DEALLOCATE": true, "DELETE": true, "DO": true,
+	"DROP": true, "FLUSH": true, "GRANT": true, "IMPORT": true, "INSERT": true,
+	"INSTALL": true, "KILL": true, "LOAD": true, "LOCK": true, "PREPARE": true,
+	"PURGE": true, "RELEASE": true, "RENAME": true, "REPLACE": true, "RESET": true,
+	"REVOKE": true, "ROLLBACK": true, "SAVEPOINT": true, "SET": true, "SHUTDOWN": true,
+	"START": true, "STOP": true, "TRUNCATE": true, "UNINSTALL": true, "UNLOCK": true,
+	"UPDATE": true, "USE": true,
+}
+
+// ClassifyStatement tells whether a statement returns a result set, ignoring
+// comments, whitespace and enclosing parentheses
+func ClassifyStatement(query string) StatementResult {
+	tokens := lexSQL(query)
+	first := firstKeyword(tokens)
+	if first < 0 {
+		return StatementMayReturnRows
+	}
+	keyword := strings.ToUpper(tokens[first].text)
+	rest := tokens[first+1:]
+
+	switch {
+	case rowStatements[keyword]:
+		return StatementReturnsRows
+	case tableMaintenance[keyword]:
+		if len(rest) > 0 && (rest[0].is("TABLE") || rest[0].is("TABLES")) {
+			return StatementReturnsRows
+		}
+		return StatementMayReturnRows
+	case keyword == "INSERT" || keyword == "REPLACE" || keyword == "DELETE":
+		// MariaDB's ... RETURNING
+		if hasTopLevelWord(rest, "RETURNING") {
+			return StatementReturnsRows
+		}
+		return StatementNoRows
+	case noRowStatements[keyword]:
+		return StatementNoRows
+	}
+	return StatementMayReturnRows
+}
+
+// RedactLiterals replaces string and numeric literals with "?", keeping the
+// rest of the query as written
+func RedactLiterals(query string) string {
+	var b strings.Builder
+	last := 0
+	for _, t := range lexSQL(query) {
+		if t.kind != tokString && t.kind != tokNumber {
+			continue
+		}
+		b.WriteString(query[last:t.start])
+		b.WriteByte('?')
+		last = t.end
+	}
+	b.WriteString(query[last:])
+	return b.String()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Streaming configuration
+const (
+	// FlushThreshold is the number of buffered response bytes after which the
+	// tunnel pushes data to the client.
+	FlushThreshold = 64 << 10
+	// SpoolMemoryLimit is how much row data a result set keeps in memory
+	// before spilling to a temporary file.
+	SpoolMemoryLimit = 4 << 20
+)
+
+// flushWriter flushes the underlying ResponseWriter after every write so
+// buffered chunks leave the process immediately.
+type flushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		err = fw.rc.Flush()
+		if errors.Is(err, http.ErrNotSupported) {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// NewStreamWriter wraps an http.ResponseWriter in a buffered writer which is
+// flushed to the client every FlushThreshold bytes. Callers must call Flush
+// once the response is complete.
+func NewStreamWriter(w http.ResponseWriter) *bufio.Writer {
+	return bufio.NewWriterSize(flushWriter{w: w, rc: http.NewResponseController(w)}, FlushThreshold)
+}
+
+// responseWriter counts the bytes of a tunnel response. With a timeout set,
+// each write gets its own deadline instead of one for the whole response, so
+// results may stream for as long as the client keeps reading them while a
+// stalled client is still dropped.
+type responseWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+	written int64
+}
+
+func newResponseWriter(w http.ResponseWriter, timeout time.Duration) *responseWriter {
+	return &responseWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.timeout > 0 {
+		rw.rc.SetWriteDeadline(time.Now().Add(rw.timeout))
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the server's writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// ResultLimit caps the rows and encoded bytes sent for each result set.
+// Zero values mean no limit.
+type ResultLimit struct {
+	MaxRows  int
+	MaxBytes int64
+	// Fail reports the query as failed after the rows sent, rather than
+	// following them with a notice
+	Fail bool
+}
+
+// ResultTruncated is returned when a result set hits its ResultLimit. Rows
+// is the number of rows sent.
+type ResultTruncated struct {
+	Rows  uint32
+	Limit string
+}
+
+func (e *ResultTruncated) Error() string {
+	return fmt.Sprintf("result set truncated after %d rows: %s", e.Rows, e.Limit)
+}
+
+// errAbortedConn answers the queries of a request following a truncated or
+// oversized result set whose statement could not be killed, so its
+// connection was closed to stop it
+var errAbortedConn = errors.New("not run: the connection was closed to stop an earlier statement")
+
+// RowSpool collects encoded row blocks for a single result set.
+//
+// The Navicat result set header carries the row count before any row data,
+// so rows cannot be forwarded until the last one has been read. RowSpool
+// keeps small result sets in memory and moves anything larger than its
+// memory limit into a temporary file, so memory use stays flat no matter how
+// many rows a query returns. Writes beyond maxSize fail with
+// *SpoolFullError, so the disk use of a result set is bounded as well.
+type RowSpool struct {
+	limit   int
+	maxSize int64 // no bound if 0
+	mem     bytes.Buffer
+	file    *os.File
+	out     *bufio.Writer
+	size    int64
+}
+
+// SpoolFullError is returned when a result set outgrows its spool
+type SpoolFullError struct {
+	MaxSize int64
+}
+
+func (e *SpoolFullError) Error() string {
+	return fmt.Sprintf("result set exceeds the spool limit of %d bytes, narrow the query or add a LIMIT", e.MaxSize)
+}
+
+// NewRowSpool creates a spool that spills to disk after limit bytes and
+// holds at most maxSize bytes, or any amount if maxSize is 0
+func NewRowSpool(limit int, maxSize int64) *RowSpool {
+	return &RowSpool{limit: limit, maxSize: maxSize}
+}
+
+// Write appends encoded row data to the spool
+func (s *RowSpool) Write(p []byte) (int, error) {
+	if s.maxSize > 0 && s.size+int64(len(p)) > s.maxSize {
+		return 0, &SpoolFullError{MaxSize: s.maxSize}
+	}
+	if s.file == nil && s.mem.Len()+len(p) > s.limit {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.out.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// spill moves the in-memory buffer into a temporary file
+func (s *RowSpool) spill() error {
+	f, err := os.CreateTemp("", "ntunnel-spool-*")
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.out = bufio.NewWriterSize(f, FlushThreshold)
+	if _, err := s.mem.WriteTo(s.out); err != nil {
+		return err
+	}
+	s.mem = bytes.Buffer{}
+	return nil
+}
+
+// WriteTo copies the spooled data to w
+func (s *RowSpool) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		return s.mem.WriteTo(w)
+	}
+	if err := s.out.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close releases the spool and removes its temporary file, if any
+func (s *RowSpool) Close() error {
+	s.mem = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	os.Remove(name)
+	s.file = nil
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRowSpool(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		writes  []string
+		spilled bool
+	}{
+		{"empty", 8, nil, false},
+		{"in memory", 8, []string{"abc", "defgh"}, false},
+		{"spilled", 8, []string{"abc", "defgh", "ij"}, true},
+		{"spilled by one write", 4, []string{"abcdefgh"}, true},
+	}
+	for _, tt := range tests {
+		s := NewRowSpool(tt.limit, 0)
+		var want bytes.Buffer
+		for _, p := range tt.writes {
+			if n, err := s.Write([]byte(p)); n != len(p) || err != nil {
+				t.Fatalf("%s: Write(%q) = %d, %v", tt.name, p, n, err)
+			}
+			want.WriteString(p)
+		}
+		if spilled := s.file != nil; spilled != tt.spilled {
+			t.Errorf("%s: spilled = %v, want %v", tt.name, spilled, tt.spilled)
+		}
+
+		var got bytes.Buffer
+		n, err := s.WriteTo(&got)
+		if err != nil || n != int64(want.Len()) || got.String() != want.String() {
+			t.Errorf("%s: WriteTo = %q, %d, %v, want %q", tt.name, got.String(), n, err, want.String())
+		}
+
+		var name string
+		if s.file != nil {
+			name = s.file.Name()
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("%s: Close: %v", tt.name, err)
+		}
+		if name != "" {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("%s: temporary file %s left after Close: %v", tt.name, name, err)
+			}
+		}
+	}
+}
+
+func TestRowSpoolMaxSize(t *testing.T) {
+	s := NewRowSpool(4, 10)
+	defer s.Close()
+	if _, err := s.Write([]byte("abcdefgh")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.Write([]byte("ijk"))
+	var full *SpoolFullError
+	if n != 0 || !errors.As(err, &full) || full.MaxSize != 10 {
+		t.Fatalf("Write beyond the max size = %d, %v, want a *SpoolFullError", n, err)
+	}
+	// The write that failed left nothing behind
+	if _, err := s.Write([]byte("ij")); err != nil {
+		t.Fatalf("Write up to the max size: %v", err)
+	}
+	var got bytes.Buffer
+	if _, err := s.WriteTo(&got); err != nil || got.String() != "abcdefghij" {
+		t.Errorf("WriteTo = %q, %v, want %q", got.String(), err, "abcdefghij")
+	}
+}
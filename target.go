@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultDeniedTargets are blocked in addition to any configured deny list,
+// unless turned off: the link-local ranges which hold cloud metadata
+// services.
+var DefaultDeniedTargets = []string{"169.254.0.0/16", "fe80::/10", "fd00:ec2::254/128"}
+
+// TargetPolicy decides which upstream servers the tunnel may connect to.
+//
+// A target is refused if its port or host name is denied, and each address
+// the host name resolves to is skipped if it is denied. If allow rules exist,
+// an address must also match one of them by host name or network, and a port
+// allowlist restricts the port. Host names are resolved once when dialing
+// and the connection goes to the checked address, so DNS answers cannot
+// change between check and use.
+type TargetPolicy struct {
+	AllowHosts []string // host names, "*.example.com" matches subdomains
+	AllowNets  []*net.IPNet
+	AllowPorts map[int]bool
+	DenyHosts  []string
+	DenyNets   []*net.IPNet
+	DenyPorts  map[int]bool
+}
+
+// NewTargetPolicy builds a policy from comma separated rule lists. Unless
+// allowLinkLocal is set, DefaultDeniedTargets are added to the deny list.
+func NewTargetPolicy(allow, deny, allowPorts, denyPorts string, allowLinkLocal bool) (*TargetPolicy, error) {
+	if !allowLinkLocal {
+		deny = strings.Join(append(DefaultDeniedTargets[:len(DefaultDeniedTargets):len(DefaultDeniedTargets)], deny), ",")
+	}
+
+	tp := &TargetPolicy{}
+	var err error
+	if tp.AllowHosts, tp.AllowNets, err = ParseTargetRules(allow); err != nil {
+		return nil, err
+	}
+	if tp.DenyHosts, tp.DenyNets, err = ParseTargetRules(deny); err != nil {
+		return nil, err
+	}
+	if tp.AllowPorts, err = ParsePorts(allowPorts); err != nil {
+		return nil, err
+	}
+	if tp.DenyPorts, err = ParsePorts(denyPorts); err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+// ParseTargetRules parses a comma separated list of host names, IP
+// addresses and CIDR ranges
+func ParseTargetRules(list string) (hosts []string, nets []*net.IPNet, err error) {
+	for _, rule := range strings.Split(list, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if strings.Contains(rule, "/") {
+			_, ipNet, err := net.ParseCIDR(rule)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, ipNet)
+		} else if ip := net.ParseIP(rule); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			hosts = append(hosts, strings.ToLower(rule))
+		}
+	}
+	return hosts, nets, nil
+}
+
+// ParsePorts parses a comma separated list of ports
+func ParsePorts(list string) (map[int]bool, error) {
+	ports := make(map[int]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		port, err := strconv.Atoi(item)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports[port] = true
+	}
+	return ports, nil
+}
+
+// matchHost reports whether name matches one of the host patterns
+func matchHost(patterns []string, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, pattern := range patterns {
+		if pattern == name {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(name, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPort reports an error if port may not be dialed
+func (tp *TargetPolicy) checkPort(port int) error {
+	if tp.DenyPorts[port] || (len(tp.AllowPorts) > 0 && !tp.AllowPorts[port]) {
+		return fmt.Errorf("target port %d is not allowed", port)
+	}
+	return nil
+}
+
+// allowed reports whether host, resolved to ip, may be dialed
+func (tp *TargetPolicy) allowed(host string, ip net.IP) bool {
+	if matchHost(tp.DenyHosts, host) || containsIP(tp.DenyNets, ip) {
+		return false
+	}
+	if len(tp.AllowHosts) == 0 && len(tp.AllowNets) == 0 {
+		return true
+	}
+	return matchHost(tp.AllowHosts, host) || containsIP(tp.AllowNets, ip)
+}
+
+// DialContext dials addr if the policy allows it. It is registered with the
+// MySQL driver for the tcp network.
+func (tp *TargetPolicy) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target port %q", portStr)
+	}
+	if err := tp.checkPort(port); err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, a := range addrs {
+		if !tp.allowed(host, a.IP) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(a.IP.String(), portStr))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("target host %s is not allowed", host)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewTargetPolicyDefaultDeny(t *testing.T) {
+	metadata := net.ParseIP("169.254.169.254")
+	internal := net.ParseIP("10.0.0.5")
+	tests := []struct {
+		deny           string
+		allowLinkLocal bool
+		metadataOK     bool
+		internalOK     bool
+	}{
+		{"", false, false, true},
+		{"10.0.0.0/8", false, false, false},
+		{"", true, true, true},
+		{"10.0.0.0/8", true, true, false},
+	}
+	for _, tt := range tests {
+		tp, err := NewTargetPolicy("", tt.deny, "", "", tt.allowLinkLocal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tp.allowed("metadata", metadata); got != tt.metadataOK {
+			t.Errorf("deny %q, allowLinkLocal %v: metadata allowed = %v", tt.deny, tt.allowLinkLocal, got)
+		}
+		if got := tp.allowed("db", internal); got != tt.internalOK {
+			t.Errorf("deny %q, allowLinkLocal %v: 10.0.0.5 allowed = %v", tt.deny, tt.allowLinkLocal, got)
+		}
+	}
+}
+
+func TestTargetPolicyDialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tests := []struct {
+		name        string
+		allow, deny string
+		allowPorts  string
+		addr        string
+		wantRefusal string
+	}{
+		{"allowed by default", "", "", "", "localhost:" + port, ""},
+		{"address denied", "", "127.0.0.0/8", "", "127.0.0.1:" + port, "target host 127.0.0.1 is not allowed"},
+		// A name which is not denied itself but resolves to a denied
+		// address, as a rebinding DNS answer would, is checked at dial time
+		{"name resolving to a denied address", "", "127.0.0.0/8, ::1", "", "localhost:" + port, "target host localhost is not allowed"},
+		{"deny beats allow", "localhost", "127.0.0.0/8, ::1", "", "localhost:" + port, "target host localhost is not allowed"},
+		{"name not allowed", "db.example.com", "", "", "localhost:" + port, "target host localhost is not allowed"},
+		{"address allowed", "127.0.0.1", "", "", "localhost:" + port, ""},
+		{"port not allowed", "", "", "3306", "localhost:" + port, "target port " + port + " is not allowed"},
+	}
+	for _, tt := range tests {
+		tp, err := NewTargetPolicy(tt.allow, tt.deny, tt.allowPorts, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tp.DialContext(context.Background(), tt.addr)
+		if tt.wantRefusal == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+				t.Errorf("%s: connected to %s", tt.name, conn.RemoteAddr())
+			}
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: dialed %s, want it refused", tt.name, tt.addr)
+		} else if !strings.Contains(err.Error(), tt.wantRefusal) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantRefusal)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// UpstreamTLS is a named TLS configuration for connections to MySQL servers.
+// Besides the names registered from it, profiles and the default may use the
+// driver's built-in "true", "skip-verify" and "preferred".
+type UpstreamTLS struct {
+	CA         string `json:"ca"`          // PEM bundle of trusted CAs, system roots if empty
+	Cert       string `json:"cert"`        // client certificate
+	Key        string `json:"key"`         // client key
+	ServerName string `json:"server_name"` // expected server name, the host if empty
+	SkipVerify bool   `json:"skip_verify"` // for development only
+}
+
+// Config builds the tls.Config for these settings
+func (u UpstreamTLS) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.SkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if u.CA != "" {
+		pem, err := os.ReadFile(u.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", u.CA)
+		}
+	}
+
+	if u.Cert != "" || u.Key != "" {
+		cert, err := tls.LoadX509KeyPair(u.Cert, u.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// RegisterUpstreamTLS reads a JSON file mapping names to TLS settings and
+// registers each with the MySQL driver, so connection profiles and requests
+// can refer to them by name. It returns the names requests may select: all
+// but those skipping certificate verification.
+func RegisterUpstreamTLS(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]UpstreamTLS
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	selectable := make(map[string]bool)
+	for name, u := range configs {
+		switch name {
+		case "true", "false", "skip-verify", "preferred":
+			return nil, fmt.Errorf("%s: %q is reserved by the driver", path, name)
+		}
+		cfg, err := u.Config()
+		if err != nil {
+			return nil, fmt.Errorf("tls config %q: %v", name, err)
+		}
+		if err := mysql.RegisterTLSConfig(name, cfg); err != nil {
+			return nil, fmt.Errorf("tls config %q: %v", name, err)
+		}
+		if !u.SkipVerify {
+			selectable[name] = true
+		}
+	}
+	return selectable, nil
+}